@@ -0,0 +1,28 @@
+package sfstreams
+
+// joinBroadcast attaches a new reader to the key's live broadcast, if there is one. g.mu must be held.
+func (g *KeyedGroup[K]) joinBroadcast(key K) (*pipeReader, *fanOut) {
+	if !g.Broadcast {
+		return nil, nil
+	}
+	out, ok := g.broadcasts[key]
+	if !ok {
+		return nil, nil
+	}
+	if r := out.attach(); r != nil {
+		return r, out
+	}
+
+	// The broadcast is winding down, so let the caller start a new one
+	delete(g.broadcasts, key)
+	return nil, nil
+}
+
+// endBroadcast stops new callers from joining a broadcast which has finished copying.
+func (g *KeyedGroup[K]) endBroadcast(key K, out *fanOut) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.broadcasts[key] == out {
+		delete(g.broadcasts, key)
+	}
+}
@@ -0,0 +1,144 @@
+package sfstreams
+
+import (
+	"encoding/binary"
+	"io"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// counterSource produces an endless sequence of 8-byte counter values, one per Read.
+type counterSource struct {
+	n      uint64
+	closed *atomic.Bool
+}
+
+func (c *counterSource) Read(p []byte) (int, error) {
+	if c.closed.Load() {
+		return 0, io.ErrClosedPipe
+	}
+	time.Sleep(2 * time.Millisecond)
+	binary.BigEndian.PutUint64(p, c.n)
+	c.n++
+	return 8, nil
+}
+
+func (c *counterSource) Close() error {
+	c.closed.Store(true)
+	return nil
+}
+
+func readCounter(t *testing.T, r io.Reader) uint64 {
+	b := make([]byte, 8)
+	if _, err := io.ReadFull(r, b); err != nil {
+		t.Fatal(err)
+	}
+	return binary.BigEndian.Uint64(b)
+}
+
+func TestBroadcastLateJoiner(t *testing.T) {
+	mu := new(sync.Mutex)
+	callCount := 0
+	closed := new(atomic.Bool)
+	workFn := func() (io.ReadCloser, error) {
+		mu.Lock()
+		callCount++
+		mu.Unlock()
+		return &counterSource{closed: closed}, nil
+	}
+
+	g := new(Group)
+	g.Broadcast = true
+	r1, err, shared := g.Do("key", workFn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if shared {
+		t.Error("Expected the first caller to not be shared")
+	}
+
+	// Keep the first reader reading in the background
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		last := readCounter(t, r1)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			n := readCounter(t, r1)
+			if n != last+1 {
+				t.Errorf("Expected counter %d, got %d", last+1, n)
+				return
+			}
+			last = n
+		}
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	r2, err, shared := g.Do("key", workFn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !shared {
+		t.Error("Expected the late joiner to be shared")
+	}
+	first := readCounter(t, r2)
+	if first == 0 {
+		t.Error("Expected the late joiner to start at the current position")
+	}
+	if second := readCounter(t, r2); second != first+1 {
+		t.Errorf("Expected counter %d, got %d", first+1, second)
+	}
+
+	close(stop)
+	<-done
+	_ = r1.Close()
+	if closed.Load() {
+		t.Error("Expected the source to remain open while a reader remains")
+	}
+	_ = r2.Close()
+	time.Sleep(20 * time.Millisecond)
+	if !closed.Load() {
+		t.Error("Expected the source to be closed after the last reader closed")
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if callCount != 1 {
+		t.Errorf("Expected 1 call, got %d", callCount)
+	}
+}
+
+func TestBroadcastRestartsAfterEnd(t *testing.T) {
+	key, expectedBytes, _ := makeStream()
+	callCount := 0
+	workFn := func() (io.ReadCloser, error) {
+		callCount++
+		_, _, src := makeStream()
+		return src, nil
+	}
+
+	g := new(Group)
+	g.Broadcast = true
+	for i := 0; i < 2; i++ {
+		r, err, _ := g.Do(key, workFn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c, _ := io.Copy(io.Discard, r)
+		if c != expectedBytes {
+			t.Errorf("Read %d bytes but expected %d", c, expectedBytes)
+		}
+		_ = r.Close()
+		time.Sleep(10 * time.Millisecond) // let the broadcast wind down
+	}
+	if callCount != 2 {
+		t.Errorf("Expected 2 calls, got %d", callCount)
+	}
+}
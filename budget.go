@@ -0,0 +1,105 @@
+package sfstreams
+
+import (
+	"context"
+	"io"
+	"sync"
+	"sync/atomic"
+
+	"golang.org/x/sync/semaphore"
+)
+
+// defaultChunkSize matches the buffer size io.Copy uses.
+const defaultChunkSize = 32 * 1024
+
+// memoryBudget limits how many bytes of stream data the copy path may hold in memory at once.
+type memoryBudget struct {
+	sem       *semaphore.Weighted
+	chunkSize int64
+	inUse     atomic.Int64
+	buffers   sync.Pool
+}
+
+func newMemoryBudget(size int64) *memoryBudget {
+	chunkSize := int64(defaultChunkSize)
+	if chunkSize > size {
+		chunkSize = size
+	}
+	b := &memoryBudget{
+		sem:       semaphore.NewWeighted(size),
+		chunkSize: chunkSize,
+	}
+	b.buffers.New = func() interface{} {
+		buf := make([]byte, b.chunkSize)
+		return &buf
+	}
+	return b
+}
+
+// copy behaves like io.Copy, but charges each chunk against the budget while it is held in memory.
+// When the budget is exhausted, copy waits before reading more from src.
+func (b *memoryBudget) copy(ctx context.Context, dst io.Writer, src io.Reader) (int64, error) {
+	total := int64(0)
+	for {
+		if err := acquire(ctx, b.sem, b.chunkSize); err != nil {
+			return total, err
+		}
+		b.inUse.Add(b.chunkSize)
+		buf := b.buffers.Get().(*[]byte)
+
+		n, readErr := src.Read(*buf)
+		var writeErr error
+		if n > 0 {
+			var written int
+			written, writeErr = dst.Write((*buf)[:n])
+			total += int64(written)
+			if written < n && writeErr == nil {
+				writeErr = io.ErrShortWrite
+			}
+		}
+
+		b.buffers.Put(buf)
+		b.inUse.Add(-b.chunkSize)
+		b.sem.Release(b.chunkSize)
+
+		if writeErr != nil {
+			return total, writeErr
+		}
+		if readErr == io.EOF {
+			return total, nil
+		}
+		if readErr != nil {
+			return total, readErr
+		}
+	}
+}
+
+// tryCharge charges n bytes held outside of the copy path, such as by the cache, against the budget.
+// It returns false without waiting if the charge wouldn't leave room for the copy path to read
+// another chunk, so long-lived charges never starve the copies.
+func (b *memoryBudget) tryCharge(n int64) bool {
+	if !b.sem.TryAcquire(n + b.chunkSize) {
+		return false
+	}
+	b.sem.Release(b.chunkSize)
+	b.inUse.Add(n)
+	return true
+}
+
+// release returns n bytes charged by tryCharge to the budget.
+func (b *memoryBudget) release(n int64) {
+	b.inUse.Add(-n)
+	b.sem.Release(n)
+}
+
+// MemoryInUse returns the number of bytes currently charged against the MemoryBudget, including the
+// streams held in memory by the cache. When no budget is set, this is always zero.
+func (g *KeyedGroup[K]) MemoryInUse() int64 {
+	g.mu.Lock()
+	b := g.budget
+	g.mu.Unlock()
+	if b == nil {
+		return 0
+	}
+	return b.inUse.Load()
+}
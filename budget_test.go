@@ -0,0 +1,76 @@
+package sfstreams
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+// budgetCheckReader fails the test if the group's memory usage exceeds the budget while reading.
+type budgetCheckReader struct {
+	r      io.Reader
+	g      *Group
+	budget int64
+	t      *testing.T
+}
+
+func (b *budgetCheckReader) Read(p []byte) (int, error) {
+	if inUse := b.g.MemoryInUse(); inUse > b.budget {
+		b.t.Errorf("Memory in use (%d) exceeds budget (%d)", inUse, b.budget)
+	}
+	return b.r.Read(p)
+}
+
+func (b *budgetCheckReader) Close() error {
+	return nil
+}
+
+func TestMemoryBudget(t *testing.T) {
+	const budget = 4096
+	src := make([]byte, 64*1024)
+	_, _ = rand.Read(src)
+
+	g := new(Group)
+	g.MemoryBudget = budget
+	workFn := func() (io.ReadCloser, error) {
+		return &budgetCheckReader{r: bytes.NewReader(src), g: g, budget: budget, t: t}, nil
+	}
+
+	wg := new(sync.WaitGroup)
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			r, err, _ := g.Do("key"+strconv.Itoa(i%4), workFn)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			//goland:noinspection GoUnhandledErrorResult
+			defer r.Close()
+			b, err := io.ReadAll(r)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if !bytes.Equal(b, src) {
+				t.Error("Read bytes do not match source")
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if inUse := g.MemoryInUse(); inUse != 0 {
+		t.Errorf("Expected no memory in use after reading, got %d", inUse)
+	}
+}
+
+func TestMemoryInUseWithoutBudget(t *testing.T) {
+	g := new(Group)
+	if inUse := g.MemoryInUse(); inUse != 0 {
+		t.Errorf("Expected no memory in use, got %d", inUse)
+	}
+}
@@ -0,0 +1,534 @@
+package sfstreams
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	// DefaultCacheMaxEntrySize is the MaxEntrySize of caches held in memory when none is set.
+	DefaultCacheMaxEntrySize = 8 << 20 // 8mb
+
+	// DefaultCacheMaxSize is the MaxSize of caches held in memory when none is set.
+	DefaultCacheMaxSize = 64 << 20 // 64mb
+
+	// DefaultRefreshAfterHits is the RefreshAfterHits used when none is set.
+	DefaultRefreshAfterHits = 10
+)
+
+// CachePolicy describes how completed streams are cached by a Group (see KeyedGroup.Cache).
+type CachePolicy struct {
+	// TTL is how long a cached stream is served for before it is considered stale.
+	TTL time.Duration
+
+	// StaleWhileRevalidate, when greater than zero, is how long a stale stream may still be served
+	// after its TTL. The first call to receive a stale stream starts a single background flight to
+	// refresh it, and the refreshed stream replaces the stale one once it has been copied to the end.
+	// Until then, callers keep receiving the stale stream (see Result.Stale). When zero (the default),
+	// stale streams are dropped, and the next call starts a new flight like any other.
+	StaleWhileRevalidate time.Duration
+
+	// MaxEntrySize is the largest stream in bytes which will be cached. Larger streams are still shared
+	// with their readers, but not cached. When zero (the default), DefaultCacheMaxEntrySize is used for
+	// caches held in memory, while streams of any size are cached on disk (see Dir). Negative values
+	// remove the limit.
+	MaxEntrySize int64
+
+	// MaxSize is the most bytes of streams the cache holds at once. When a stream is cached, the least
+	// recently used streams are evicted to make room for it. When zero (the default),
+	// DefaultCacheMaxSize is used for caches held in memory, while the cache on disk (see Dir) is
+	// unlimited. Negative values remove the limit.
+	//
+	// Streams held in memory are also charged against the Group's MemoryBudget, if it has one. A stream
+	// which would exceed the budget is not cached.
+	MaxSize int64
+
+	// RefreshAhead, when greater than zero and less than TTL, is how long before its TTL a popular
+	// cached stream is refreshed in the background, so it is replaced before it goes stale rather than
+	// causing a cold miss. The refresh runs as a normal flight for the key, which callers arriving
+	// while the work function runs join. Streams which are not popular are left to expire.
+	RefreshAhead time.Duration
+
+	// RefreshAfterHits is how many times a cached stream must have been served from the cache before
+	// it is considered popular (see RefreshAhead). Only calls served since the stream was cached count,
+	// not the callers of the flight which filled the cache. When less than 1 (the default),
+	// DefaultRefreshAfterHits is used.
+	RefreshAfterHits int
+
+	// Dir, when set, keeps cached streams as files in the directory rather than in memory. Streams are
+	// spooled to a temporary file while they are copied, which is only added to the cache once the copy
+	// completes. An index of the cached streams is kept alongside them, so the cache is reused after the
+	// process restarts rather than discarded: at startup, streams which are expired, incomplete, or
+	// don't match their recorded size and digest are removed, as are files left behind by a crash.
+	// The index is loaded in the background once the Group is first used, and calls for the keys of
+	// streams which haven't been verified yet are treated as misses. Changes to the index are written
+	// in batches in the background, so call KeyedGroup.Close before the process exits to write the
+	// latest ones.
+	//
+	// Within a process, Dir must only be used by one Group at a time: a Group panics when it is first
+	// used if another Group is using its Dir, until that Group is closed. ShardedGroup gives each shard
+	// a directory of its own. Processes may overlap on the same Dir, such as during a rolling deploy,
+	// without corrupting the cache: each leaves the files of the other alone while it is running (see
+	// SweepInterval), and streams are verified before they are reused. However, each process writes
+	// the index with its own streams only, so the streams of whichever process didn't write the index
+	// last are not reused, and are swept once that process has exited.
+	//
+	// Keys and metadata (see SetMeta) are stored in the index as JSON, so keys must survive being
+	// encoded and decoded as JSON. Streams whose key or metadata can't be encoded are cached, but not
+	// reused after a restart. Metadata loaded from the index is given to callers as a json.RawMessage,
+	// which DoWithMeta decodes automatically.
+	//
+	// The directory must exist.
+	Dir string
+
+	// SpoolDir is where streams are spooled to while they are copied, when Dir is set. It must be on
+	// the same filesystem as Dir, as completed spool files are moved into Dir. When empty (the
+	// default), Dir is used. Spool files are named after the process which wrote them, and are removed
+	// as soon as the stream is cached or turns out not to be cacheable. SpoolDir may be shared with
+	// other software, such as when it's os.TempDir().
+	SpoolDir string
+
+	// SweepInterval, when greater than zero, is how often SpoolDir and Dir are swept for files the
+	// Group no longer knows about, such as cached streams which couldn't be removed at the time. The
+	// directories are also swept when the Group starts, regardless of this setting, which removes the
+	// files left behind by a crashed process. KeyedGroup.Close stops the background sweeps.
+	//
+	// Sweeps only remove files named like the ones the Group writes, and only once the process which
+	// wrote them has exited, so other processes using the same directories (such as during a rolling
+	// deploy) are left alone. This relies on the processes sharing process IDs, such as by running on
+	// the same host. Files named after the current process, such as those of a crashed process which
+	// had the same ID (as is common in containers), are only removed once they haven't been modified
+	// for an interval. When SweepInterval isn't set, a minute is used instead, and the directories
+	// are swept once more a minute after the Group starts.
+	SweepInterval time.Duration
+}
+
+// limits returns the largest stream which may be cached, and the most bytes the cache may hold at
+// once. Zero or less means there is no limit.
+func (p *CachePolicy) limits() (maxEntry int64, maxSize int64) {
+	maxEntry, maxSize = p.MaxEntrySize, p.MaxSize
+	if p.Dir == "" {
+		if maxEntry == 0 {
+			maxEntry = DefaultCacheMaxEntrySize
+		}
+		if maxSize == 0 {
+			maxSize = DefaultCacheMaxSize
+		}
+	}
+	if maxSize > 0 && (maxEntry <= 0 || maxEntry > maxSize) {
+		maxEntry = maxSize
+	}
+	return maxEntry, maxSize
+}
+
+// cacheEntry is a completed stream held by the cache.
+type cacheEntry struct {
+	data    []byte // the stream, when held in memory
+	file    string // the path of the stream, when held on disk (see CachePolicy.Dir)
+	size    int64
+	digest  string // hex-encoded SHA-256 of the stream, when held on disk
+	meta    any
+	expires time.Time // when the entry becomes stale
+
+	// refreshing is set while a background flight is refreshing the entry
+	refreshing bool
+
+	// restart starts a background flight to refresh the entry ahead of expiry (see RefreshAhead), when
+	// there is no caller whose work function could be used instead. It is nil for entries loaded from
+	// disk until a caller for the key arrives. It reports whether a flight was started. g.mu must be
+	// held.
+	restart func() bool
+
+	// hits is how many calls the entry's stream has been served to from the cache
+	hits int
+
+	// elem is the entry's place in the cache's eviction order, see CachePolicy.MaxSize
+	elem *list.Element
+
+	// expiry drops the entry once it can no longer be served, and refreshTimer refreshes it ahead of
+	// expiry (see RefreshAhead). Both are stopped once the entry leaves the cache, so they don't keep
+	// it alive.
+	expiry       *time.Timer
+	refreshTimer *time.Timer
+
+	// refs tracks the entry itself and the readers of its stream, which is released once the entry has
+	// been removed from the cache and every reader has been closed: its file is removed, or its memory
+	// is returned to the MemoryBudget.
+	refs    *refCount
+	removed bool
+}
+
+// reader opens the entry's stream.
+func (e *cacheEntry) reader() (io.ReadCloser, error) {
+	if !e.refs.acquire() {
+		return nil, os.ErrNotExist
+	}
+	if e.file == "" {
+		return &cachedReader{r: bytes.NewReader(e.data), release: e.refs.done}, nil
+	}
+	f, err := os.Open(e.file)
+	if err != nil {
+		e.refs.done()
+		return nil, err
+	}
+	return &cachedFile{File: f, release: e.refs.done}, nil
+}
+
+// cachedResult returns the cached stream for key, if there is one, starting a background flight to
+// refresh it with the caller's work function if it's stale. g.mu must be held.
+func (g *KeyedGroup[K]) cachedResult(key K, fn func(ctx context.Context) (io.ReadCloser, error), resume func(ctx context.Context, offset int64) (io.ReadCloser, error), opts []CallOption) (Result, bool) {
+	e, ok := g.cache[key]
+	if !ok {
+		return Result{}, false
+	}
+	if e.restart == nil {
+		e.restart = func() bool {
+			return g.refresh(key, fn, resume, opts)
+		}
+	}
+
+	stale := !time.Now().Before(e.expires)
+	if stale {
+		if g.Cache == nil || !time.Now().Before(e.expires.Add(g.Cache.StaleWhileRevalidate)) {
+			g.dropCache(key, e)
+			return Result{}, false
+		}
+		if !e.refreshing {
+			// Dev note: the refresh uses this caller's work function rather than e.restart, which may
+			// have been captured long ago by another caller with different credentials or state.
+			e.refreshing = g.refresh(key, fn, resume, opts)
+		}
+	}
+
+	r, err := e.reader()
+	if err != nil {
+		// The file has gone missing, so treat it like a miss
+		g.dropCache(key, e)
+		return Result{}, false
+	}
+	e.hits++
+	g.cacheLRU.MoveToFront(e.elem)
+	return Result{
+		Reader: r,
+		Shared: true,
+		Cached: true,
+		Stale:  stale,
+		Meta:   e.meta,
+	}, true
+}
+
+// refresh starts a flight for key without a caller, returning whether it did. Callers arriving while
+// the work function runs join the flight as usual. g.mu must be held.
+//
+// Dev note: callers only mark the key's cached stream as refreshing when a flight was started. The
+// flight which is already running otherwise may be abandoned by its callers, and would then never
+// clear the mark.
+func (g *KeyedGroup[K]) refresh(key K, fn func(ctx context.Context) (io.ReadCloser, error), resume func(ctx context.Context, offset int64) (io.ReadCloser, error), opts []CallOption) bool {
+	if _, ok := g.calls[key]; ok {
+		return false // the flight which is already running will refresh the cache
+	}
+	f := g.newFlight(key, fn, resume, opts)
+	f.background = true
+	_ = g.sf.DoChan(f.id, g.doWork(key, f, fn, resume, g.callOptions(opts)))
+	return true
+}
+
+// refreshDone allows a stale entry for key to be refreshed again, after a flight which would have
+// refreshed it failed. g.mu must be held.
+func (g *KeyedGroup[K]) refreshDone(key K) {
+	if e, ok := g.cache[key]; ok {
+		e.refreshing = false
+	}
+}
+
+// fillCache caches the stream copied by f, if it was copied to the end.
+func (g *KeyedGroup[K]) fillCache(key K, f *flight, fill *cacheFill) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if !fill.complete || fill.failed || f.detached != nil {
+		fill.discard()
+		g.refreshDone(key)
+		return
+	}
+
+	e := &cacheEntry{
+		meta:    f.meta.get(),
+		expires: time.Now().Add(g.Cache.TTL),
+		restart: f.restart,
+	}
+	if err := fill.commit(e, g.Cache.Dir); err != nil {
+		g.refreshDone(key)
+		return
+	}
+	g.storeCache(key, e)
+	g.cacheIndexChanged()
+}
+
+// storeCache adds e to the cache, replacing any existing entry for key. g.mu must be held.
+func (g *KeyedGroup[K]) storeCache(key K, e *cacheEntry) {
+	if old, ok := g.cache[key]; ok && old != e {
+		g.unlinkCache(key, old)
+		old.remove()
+	}
+	g.cache[key] = e
+	e.elem = g.cacheLRU.PushFront(key)
+	g.cacheSize += e.size
+
+	e.expiry = time.AfterFunc(time.Until(e.expires.Add(g.Cache.StaleWhileRevalidate)), func() {
+		g.mu.Lock()
+		defer g.mu.Unlock()
+		if g.cache[key] == e {
+			g.dropCache(key, e)
+		}
+	})
+
+	if ahead := g.Cache.RefreshAhead; ahead > 0 && ahead < g.Cache.TTL {
+		threshold := g.Cache.RefreshAfterHits
+		if threshold < 1 {
+			threshold = DefaultRefreshAfterHits
+		}
+		e.refreshTimer = time.AfterFunc(time.Until(e.expires.Add(-ahead)), func() {
+			g.mu.Lock()
+			defer g.mu.Unlock()
+			if g.cache[key] == e && e.hits >= threshold && !e.refreshing && e.restart != nil {
+				e.refreshing = e.restart()
+			}
+		})
+	}
+
+	if _, maxSize := g.Cache.limits(); maxSize > 0 {
+		for g.cacheSize > maxSize {
+			oldest := g.cacheLRU.Back().Value.(K)
+			g.dropCache(oldest, g.cache[oldest])
+		}
+	}
+}
+
+// dropCache removes e, the entry for key, from the cache. g.mu must be held.
+func (g *KeyedGroup[K]) dropCache(key K, e *cacheEntry) {
+	g.unlinkCache(key, e)
+	e.remove()
+	g.cacheIndexChanged()
+}
+
+// unlinkCache removes e, the entry for key, from the cache's bookkeeping without releasing it. g.mu
+// must be held.
+func (g *KeyedGroup[K]) unlinkCache(key K, e *cacheEntry) {
+	if g.cache[key] != e {
+		return
+	}
+	delete(g.cache, key)
+	g.cacheLRU.Remove(e.elem)
+	g.cacheSize -= e.size
+	e.expiry.Stop()
+	if e.refreshTimer != nil {
+		e.refreshTimer.Stop()
+	}
+}
+
+// remove releases the entry's stream once its last reader has been closed.
+func (e *cacheEntry) remove() {
+	if e.removed {
+		return
+	}
+	e.removed = true
+	e.refs.done()
+}
+
+// cacheFill writes a flight's stream to its readers, keeping a copy of it for the cache. The copy is
+// held in memory, or spooled to a file when the cache is on disk.
+type cacheFill struct {
+	mw       *asyncMultiWriter
+	max      int64
+	size     int64
+	buf      []byte
+	budget   *memoryBudget
+	charged  int64 // how much of buf's capacity is charged against the budget
+	spooler  *spooler
+	spool    *os.File
+	hash     hash.Hash
+	failed   bool // set once the stream can't be cached, such as when it's too large
+	complete bool
+}
+
+func newCacheFill(mw *asyncMultiWriter, policy *CachePolicy, spooler *spooler, budget *memoryBudget) *cacheFill {
+	c := &cacheFill{
+		mw:      mw,
+		spooler: spooler,
+		budget:  budget,
+	}
+	c.max, _ = policy.limits()
+	if spooler == nil {
+		c.buf = make([]byte, 0)
+		return c
+	}
+	spool, err := spooler.create()
+	if err != nil {
+		c.failed = true
+		return c
+	}
+	c.spool = spool
+	c.hash = sha256.New()
+	return c
+}
+
+func (c *cacheFill) Write(p []byte) (int, error) {
+	if !c.failed {
+		c.size += int64(len(p))
+		if c.max > 0 && c.size > c.max {
+			c.fail()
+		} else if c.spool != nil {
+			if _, err := c.spool.Write(p); err != nil {
+				c.fail()
+			} else {
+				c.hash.Write(p)
+			}
+		} else if !c.grow(len(p)) {
+			c.fail() // caching the stream would exceed the memory budget
+		} else {
+			c.buf = append(c.buf, p...)
+		}
+	}
+	n, err := c.mw.Write(p)
+	if errors.Is(err, ErrAborted) && !c.failed {
+		// Nobody is reading, but the stream is still wanted for the cache
+		return len(p), nil
+	}
+	return n, err
+}
+
+// grow makes room in buf for n more bytes, charging the memory it allocates against the budget.
+// It returns false if the budget can't cover it.
+func (c *cacheFill) grow(n int) bool {
+	need := len(c.buf) + n
+	if need <= cap(c.buf) {
+		return true
+	}
+	size := 2 * cap(c.buf)
+	if size < need {
+		size = need
+	}
+	if c.max > 0 && int64(size) > c.max {
+		size = int(c.max)
+	}
+	if c.budget != nil {
+		if !c.budget.tryCharge(int64(size - cap(c.buf))) {
+			return false
+		}
+		c.charged += int64(size - cap(c.buf))
+	}
+	buf := make([]byte, len(c.buf), size)
+	copy(buf, c.buf)
+	c.buf = buf
+	return true
+}
+
+// fail gives up on caching the stream.
+func (c *cacheFill) fail() {
+	c.failed = true
+	c.discard()
+}
+
+// discard drops the copy of the stream, releasing its memory or removing its spool file.
+func (c *cacheFill) discard() {
+	c.buf = nil
+	if c.charged > 0 {
+		c.budget.release(c.charged)
+		c.charged = 0
+	}
+	if c.spool != nil {
+		_ = c.spool.Close()
+		c.spooler.remove(c.spool.Name())
+		c.spool = nil
+	}
+}
+
+// commit hands the copy of the stream over to e, moving the spool file into dir.
+func (c *cacheFill) commit(e *cacheEntry, dir string) error {
+	e.size = c.size
+	if c.spool == nil {
+		e.data = c.buf
+		budget, charged := c.budget, c.charged
+		c.buf, c.charged = nil, 0
+		e.refs = newRefCount(1, 0, func() {
+			e.data = nil // free the stream even if something still refers to the entry
+			if charged > 0 {
+				budget.release(charged)
+			}
+		})
+		return nil
+	}
+
+	// Dev note: the spool file is only renamed once it is complete and synced, so a file with the
+	// final name is never partially written.
+	spool := c.spool
+	c.spool = nil
+	err := spool.Sync()
+	if closeErr := spool.Close(); err == nil {
+		err = closeErr
+	}
+	file := filepath.Join(dir, strings.TrimSuffix(filepath.Base(spool.Name()), spoolSuffix)+cacheSuffix)
+	if err == nil {
+		c.spooler.own(file)
+		if err = os.Rename(spool.Name(), file); err != nil {
+			c.spooler.disown(file)
+		}
+	}
+	if err != nil {
+		c.spooler.remove(spool.Name())
+		return err
+	}
+	c.spooler.disown(spool.Name())
+	e.file = file
+	e.digest = hex.EncodeToString(c.hash.Sum(nil))
+	e.refs = newRefCount(1, 0, func() {
+		c.spooler.remove(file)
+	})
+	return nil
+}
+
+// cachedReader reads a cached stream held in memory.
+type cachedReader struct {
+	r       *bytes.Reader
+	closed  bool
+	release func() // called once the reader is closed, allowing the stream's memory to be released
+}
+
+func (r *cachedReader) Read(p []byte) (int, error) {
+	if r.closed {
+		return 0, ErrReaderClosed
+	}
+	return r.r.Read(p)
+}
+
+func (r *cachedReader) WriteTo(w io.Writer) (int64, error) {
+	if r.closed {
+		return 0, ErrReaderClosed
+	}
+	return r.r.WriteTo(w)
+}
+
+func (r *cachedReader) Seek(offset int64, whence int) (int64, error) {
+	if r.closed {
+		return 0, ErrReaderClosed
+	}
+	return r.r.Seek(offset, whence)
+}
+
+func (r *cachedReader) Close() error {
+	if !r.closed {
+		r.closed = true
+		r.release()
+	}
+	return nil
+}
@@ -0,0 +1,360 @@
+package sfstreams
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func readResult(t *testing.T, res Result) []byte {
+	if res.Err != nil {
+		t.Fatal(res.Err)
+	}
+	//goland:noinspection GoUnhandledErrorResult
+	defer res.Reader.Close()
+	b, err := io.ReadAll(res.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestCache(t *testing.T) {
+	callCount := 0
+	workFn := func(ctx context.Context) (io.ReadCloser, error) {
+		callCount++
+		SetMeta(ctx, callCount)
+		return io.NopCloser(bytes.NewReader([]byte("call " + strconv.Itoa(callCount)))), nil
+	}
+
+	g := &Group{Cache: &CachePolicy{TTL: 50 * time.Millisecond}}
+	res := g.DoResult(context.Background(), "key", workFn)
+	if res.Cached {
+		t.Error("Expected the first call to not be cached")
+	}
+	if b := readResult(t, res); string(b) != "call 1" {
+		t.Errorf("Unexpected stream: %s", b)
+	}
+	time.Sleep(10 * time.Millisecond) // let the flight finish caching
+
+	for i := 0; i < 3; i++ {
+		res = g.DoResult(context.Background(), "key", workFn)
+		if !res.Cached || !res.Shared || res.Stale {
+			t.Errorf("Expected a fresh cached result, got %+v", res)
+		}
+		if res.Meta != 1 {
+			t.Errorf("Expected the cached metadata, got %v", res.Meta)
+		}
+		if b := readResult(t, res); string(b) != "call 1" {
+			t.Errorf("Unexpected stream: %s", b)
+		}
+	}
+	if callCount != 1 {
+		t.Errorf("Expected 1 call, got %d", callCount)
+	}
+
+	// Without StaleWhileRevalidate, expired streams are fetched again
+	time.Sleep(60 * time.Millisecond)
+	res = g.DoResult(context.Background(), "key", workFn)
+	if res.Cached {
+		t.Error("Expected the expired stream to not be served")
+	}
+	if b := readResult(t, res); string(b) != "call 2" {
+		t.Errorf("Unexpected stream: %s", b)
+	}
+}
+
+func TestCacheStaleWhileRevalidate(t *testing.T) {
+	mu := new(sync.Mutex)
+	callCount := 0
+	gate := make(chan struct{})
+	workFn := func(ctx context.Context) (io.ReadCloser, error) {
+		mu.Lock()
+		callCount++
+		call := callCount
+		mu.Unlock()
+		if call > 1 {
+			<-gate
+		}
+		return io.NopCloser(bytes.NewReader([]byte("call " + strconv.Itoa(call)))), nil
+	}
+	getCallCount := func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		return callCount
+	}
+
+	g := &Group{Cache: &CachePolicy{TTL: 50 * time.Millisecond, StaleWhileRevalidate: time.Minute}}
+	readResult(t, g.DoResult(context.Background(), "key", workFn))
+	time.Sleep(60 * time.Millisecond)
+
+	// Every caller receives the stale stream while a single flight refreshes it
+	for i := 0; i < 3; i++ {
+		res := g.DoResult(context.Background(), "key", workFn)
+		if !res.Cached || !res.Stale {
+			t.Errorf("Expected a stale cached result, got %+v", res)
+		}
+		if b := readResult(t, res); string(b) != "call 1" {
+			t.Errorf("Unexpected stream: %s", b)
+		}
+	}
+	time.Sleep(10 * time.Millisecond)
+	if getCallCount() != 2 {
+		t.Errorf("Expected 2 calls, got %d", getCallCount())
+	}
+
+	close(gate)
+	time.Sleep(10 * time.Millisecond) // let the refresh finish
+	res := g.DoResult(context.Background(), "key", workFn)
+	if !res.Cached || res.Stale {
+		t.Errorf("Expected a fresh cached result, got %+v", res)
+	}
+	if b := readResult(t, res); string(b) != "call 2" {
+		t.Errorf("Expected the refreshed stream, got %s", b)
+	}
+	if getCallCount() != 2 {
+		t.Errorf("Expected 2 calls, got %d", getCallCount())
+	}
+}
+
+func TestCacheMaxEntrySize(t *testing.T) {
+	key, expectedBytes, _ := makeStream()
+	callCount := 0
+	workFn := func() (io.ReadCloser, error) {
+		callCount++
+		_, _, src := makeStream()
+		return src, nil
+	}
+
+	g := &Group{Cache: &CachePolicy{TTL: time.Minute, MaxEntrySize: expectedBytes - 1}}
+	for i := 0; i < 2; i++ {
+		r, err, _ := g.Do(key, workFn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c, _ := io.Copy(io.Discard, r)
+		if c != expectedBytes {
+			t.Errorf("Read %d bytes but expected %d", c, expectedBytes)
+		}
+		_ = r.Close()
+		time.Sleep(10 * time.Millisecond)
+	}
+	if callCount != 2 {
+		t.Errorf("Expected 2 calls, got %d", callCount)
+	}
+}
+
+func TestCacheRefreshAhead(t *testing.T) {
+	mu := new(sync.Mutex)
+	callCount := 0
+	workFn := func(ctx context.Context) (io.ReadCloser, error) {
+		mu.Lock()
+		callCount++
+		call := callCount
+		mu.Unlock()
+		return io.NopCloser(bytes.NewReader([]byte("call " + strconv.Itoa(call)))), nil
+	}
+	getCallCount := func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		return callCount
+	}
+
+	for _, hot := range []bool{true, false} {
+		mu.Lock()
+		callCount = 0
+		mu.Unlock()
+		g := &Group{Cache: &CachePolicy{
+			TTL:              100 * time.Millisecond,
+			RefreshAhead:     50 * time.Millisecond,
+			RefreshAfterHits: 2,
+		}}
+		readResult(t, g.DoResult(context.Background(), "key", workFn))
+		time.Sleep(10 * time.Millisecond) // let the flight finish caching
+		// Only calls served from the cache count towards the stream's popularity
+		readResult(t, g.DoResult(context.Background(), "key", workFn))
+		if hot {
+			readResult(t, g.DoResult(context.Background(), "key", workFn))
+		}
+
+		time.Sleep(70 * time.Millisecond)
+		if hot && getCallCount() != 2 {
+			t.Errorf("Expected the popular stream to be refreshed ahead of expiry, got %d calls", getCallCount())
+		} else if !hot && getCallCount() != 1 {
+			t.Errorf("Expected the unpopular stream to not be refreshed, got %d calls", getCallCount())
+		}
+		if !hot {
+			continue
+		}
+
+		// The refreshed stream outlives the original
+		time.Sleep(40 * time.Millisecond)
+		res := g.DoResult(context.Background(), "key", workFn)
+		if !res.Cached || res.Stale {
+			t.Errorf("Expected a fresh cached result, got %+v", res)
+		}
+		if b := readResult(t, res); string(b) != "call 2" {
+			t.Errorf("Expected the refreshed stream, got %s", b)
+		}
+	}
+}
+
+func TestCacheRevalidateUsesCallerWork(t *testing.T) {
+	workFn := func(name string, calls *atomic.Int32) func(ctx context.Context) (io.ReadCloser, error) {
+		return func(ctx context.Context) (io.ReadCloser, error) {
+			calls.Add(1)
+			return io.NopCloser(bytes.NewReader([]byte(name))), nil
+		}
+	}
+
+	firstCalls, secondCalls := new(atomic.Int32), new(atomic.Int32)
+	g := &Group{Cache: &CachePolicy{TTL: 50 * time.Millisecond, StaleWhileRevalidate: time.Minute}}
+	readResult(t, g.DoResult(context.Background(), "key", workFn("first", firstCalls)))
+	time.Sleep(60 * time.Millisecond)
+
+	// The caller which finds the stale stream refreshes it with its own work function
+	res := g.DoResult(context.Background(), "key", workFn("second", secondCalls))
+	if !res.Stale {
+		t.Errorf("Expected a stale cached result, got %+v", res)
+	}
+	readResult(t, res)
+	time.Sleep(10 * time.Millisecond) // let the refresh finish
+
+	if firstCalls.Load() != 1 {
+		t.Errorf("Expected 1 call, got %d", firstCalls.Load())
+	}
+	if secondCalls.Load() != 1 {
+		t.Errorf("Expected 1 call, got %d", secondCalls.Load())
+	}
+	if b := readResult(t, g.DoResult(context.Background(), "key", workFn("third", new(atomic.Int32)))); string(b) != "second" {
+		t.Errorf("Expected the refreshed stream, got %s", b)
+	}
+}
+
+func TestCacheMaxSize(t *testing.T) {
+	calls := make(map[string]int)
+	workFn := func(key string) func(ctx context.Context) (io.ReadCloser, error) {
+		return func(ctx context.Context) (io.ReadCloser, error) {
+			calls[key]++
+			return io.NopCloser(bytes.NewReader([]byte(key + key + key))), nil
+		}
+	}
+	read := func(g *Group, key string) {
+		readResult(t, g.DoResult(context.Background(), key, workFn(key)))
+		time.Sleep(10 * time.Millisecond) // let the flight finish caching
+	}
+
+	// Each stream is 3 bytes, so only two fit
+	g := &Group{Cache: &CachePolicy{TTL: time.Minute, MaxSize: 6}}
+	read(g, "a")
+	read(g, "b")
+	read(g, "a")
+	read(g, "c") // evicts b, which was used least recently
+	read(g, "a")
+	read(g, "b")
+
+	expected := map[string]int{"a": 1, "b": 2, "c": 1}
+	for key, count := range expected {
+		if calls[key] != count {
+			t.Errorf("Expected %d calls for %s, got %d", count, key, calls[key])
+		}
+	}
+}
+
+func TestCacheMemoryBudget(t *testing.T) {
+	key, expectedBytes, _ := makeStream()
+	workFn := func(ctx context.Context) (io.ReadCloser, error) {
+		_, _, src := makeStream()
+		return src, nil
+	}
+
+	g := &Group{Cache: &CachePolicy{TTL: time.Minute}, MemoryBudget: 1024 * 1024}
+	readResult(t, g.DoResult(context.Background(), key, workFn))
+	time.Sleep(10 * time.Millisecond) // let the flight finish caching
+	if g.MemoryInUse() != expectedBytes {
+		t.Errorf("Expected the cached stream to be charged, got %d bytes in use", g.MemoryInUse())
+	}
+
+	// The memory is held until the cached stream is dropped and its last reader closed
+	res := g.DoResult(context.Background(), key, workFn)
+	if !res.Cached {
+		t.Fatal("Expected a cached result")
+	}
+	g.Forget(key)
+	if g.MemoryInUse() != expectedBytes {
+		t.Errorf("Expected the cached stream to be charged while it's read, got %d bytes in use", g.MemoryInUse())
+	}
+	readResult(t, res)
+	if g.MemoryInUse() != 0 {
+		t.Errorf("Expected no memory in use, got %d", g.MemoryInUse())
+	}
+
+	// Streams which don't fit in the budget are not cached
+	g = &Group{Cache: &CachePolicy{TTL: time.Minute}, MemoryBudget: expectedBytes}
+	for i := 0; i < 2; i++ {
+		res = g.DoResult(context.Background(), key, workFn)
+		if res.Cached {
+			t.Error("Expected the stream to not be cached")
+		}
+		if b := readResult(t, res); int64(len(b)) != expectedBytes {
+			t.Errorf("Read %d bytes but expected %d", len(b), expectedBytes)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if g.MemoryInUse() != 0 {
+		t.Errorf("Expected no memory in use, got %d", g.MemoryInUse())
+	}
+}
+
+func TestCacheEvictedReleased(t *testing.T) {
+	workFn := func(key string) func(ctx context.Context) (io.ReadCloser, error) {
+		return func(ctx context.Context) (io.ReadCloser, error) {
+			return io.NopCloser(bytes.NewReader([]byte(key + key + key))), nil
+		}
+	}
+
+	g := &Group{Cache: &CachePolicy{TTL: time.Hour, RefreshAhead: time.Minute, MaxSize: 3}}
+	readResult(t, g.DoResult(context.Background(), "a", workFn("a")))
+	time.Sleep(10 * time.Millisecond) // let the flight finish caching
+	g.mu.Lock()
+	e := g.cache["a"]
+	g.mu.Unlock()
+
+	readResult(t, g.DoResult(context.Background(), "b", workFn("b"))) // evicts a
+	time.Sleep(10 * time.Millisecond)
+
+	// The evicted entry's timers no longer hold on to it, and its stream is freed
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if e.expiry.Stop() || e.refreshTimer.Stop() {
+		t.Error("Expected the evicted entry's timers to be stopped")
+	}
+	if e.data != nil {
+		t.Error("Expected the evicted entry's stream to be freed")
+	}
+}
+
+func TestCacheRefreshAheadDefaultHits(t *testing.T) {
+	callCount := new(atomic.Int32)
+	workFn := func(ctx context.Context) (io.ReadCloser, error) {
+		callCount.Add(1)
+		return io.NopCloser(bytes.NewReader([]byte("hello"))), nil
+	}
+
+	// A stream requested a few times isn't popular by default
+	g := &Group{Cache: &CachePolicy{TTL: 100 * time.Millisecond, RefreshAhead: 50 * time.Millisecond}}
+	readResult(t, g.DoResult(context.Background(), "key", workFn))
+	time.Sleep(10 * time.Millisecond) // let the flight finish caching
+	for i := 0; i < DefaultRefreshAfterHits-1; i++ {
+		readResult(t, g.DoResult(context.Background(), "key", workFn))
+	}
+	time.Sleep(60 * time.Millisecond)
+	if callCount.Load() != 1 {
+		t.Errorf("Expected the unpopular stream to not be refreshed, got %d calls", callCount.Load())
+	}
+}
@@ -0,0 +1,319 @@
+package sfstreams
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	spoolSuffix = ".spool"
+	cacheSuffix = ".cache"
+
+	cacheIndexName    = "index.json"
+	cacheIndexVersion = 1
+	cacheIndexDelay   = time.Second
+)
+
+// cacheDirs holds the directories used by the disk caches of the Groups in the process, see
+// CachePolicy.Dir.
+var cacheDirs = struct {
+	sync.Mutex
+	owners map[string]any
+}{owners: make(map[string]any)}
+
+// claimCacheDir marks the cache's directory as used by g, panicking if another Group is using it.
+func (g *KeyedGroup[K]) claimCacheDir() {
+	dir := absPath(g.Cache.Dir)
+	cacheDirs.Lock()
+	defer cacheDirs.Unlock()
+	if owner, ok := cacheDirs.owners[dir]; ok && owner != any(g) {
+		panic("sfstreams: CachePolicy.Dir " + g.Cache.Dir + " is already used by another Group")
+	}
+	cacheDirs.owners[dir] = g
+}
+
+// releaseCacheDir allows another Group to use the cache's directory.
+func (g *KeyedGroup[K]) releaseCacheDir() {
+	dir := absPath(g.Cache.Dir)
+	cacheDirs.Lock()
+	defer cacheDirs.Unlock()
+	if cacheDirs.owners[dir] == any(g) {
+		delete(cacheDirs.owners, dir)
+	}
+}
+
+// absPath returns the absolute form of path, so different spellings of a path compare equal.
+func absPath(path string) string {
+	if abs, err := filepath.Abs(path); err == nil {
+		return abs
+	}
+	return filepath.Clean(path)
+}
+
+// cacheIndex is the index of the streams cached on disk (see CachePolicy.Dir).
+type cacheIndex struct {
+	Version int               `json:"version"`
+	Entries []cacheIndexEntry `json:"entries"`
+}
+
+type cacheIndexEntry struct {
+	Key     json.RawMessage `json:"key"`
+	File    string          `json:"file"`
+	Size    int64           `json:"size"`
+	Digest  string          `json:"digest"`
+	Expires time.Time       `json:"expires"`
+	Meta    json.RawMessage `json:"meta,omitempty"`
+}
+
+// cacheIndexChanged schedules the index of the streams cached on disk to be written, if the cache is
+// on disk. Changes are batched for cacheIndexDelay, so a burst of changes (such as ForgetFunc dropping
+// many keys) results in a single write. g.mu must be held.
+func (g *KeyedGroup[K]) cacheIndexChanged() {
+	if g.Cache == nil || g.Cache.Dir == "" || g.indexTimer != nil {
+		return
+	}
+	g.indexTimer = time.AfterFunc(cacheIndexDelay, func() {
+		_ = g.writeCacheIndex()
+	})
+}
+
+// writeCacheIndex writes the index of the streams cached on disk. The index is replaced atomically, so
+// a crash leaves either the old or the new index behind. Only the cache's entries are collected while
+// g.mu is held: the index is encoded and written after it has been released.
+func (g *KeyedGroup[K]) writeCacheIndex() error {
+	g.indexMu.Lock()
+	defer g.indexMu.Unlock()
+
+	g.mu.Lock()
+	g.indexTimer = nil
+	select {
+	case <-g.cacheLoaded:
+	default:
+		// The index is written once it has been loaded, so its other streams aren't lost
+		g.mu.Unlock()
+		return nil
+	}
+	spool := g.spool
+	keys := make([]K, 0, len(g.cache))
+	entries := make([]*cacheEntry, 0, len(g.cache))
+	for key, e := range g.cache {
+		if e.file != "" {
+			keys = append(keys, key)
+			entries = append(entries, e)
+		}
+	}
+	g.mu.Unlock()
+
+	index := cacheIndex{Version: cacheIndexVersion, Entries: make([]cacheIndexEntry, 0, len(entries))}
+	for i, e := range entries {
+		rawKey, err := json.Marshal(keys[i])
+		if err != nil {
+			continue // the stream can't be reused after a restart, but is otherwise fine
+		}
+		var rawMeta json.RawMessage
+		if e.meta != nil {
+			if rawMeta, err = json.Marshal(e.meta); err != nil {
+				continue
+			}
+		}
+		index.Entries = append(index.Entries, cacheIndexEntry{
+			Key:     rawKey,
+			File:    filepath.Base(e.file),
+			Size:    e.size,
+			Digest:  e.digest,
+			Expires: e.expires,
+			Meta:    rawMeta,
+		})
+	}
+
+	b, err := json.Marshal(index)
+	if err != nil {
+		return err
+	}
+	tmp, err := spool.createIn(g.Cache.Dir)
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(b)
+	if syncErr := tmp.Sync(); err == nil {
+		err = syncErr
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), filepath.Join(g.Cache.Dir, cacheIndexName))
+	}
+	if err != nil {
+		spool.remove(tmp.Name())
+	} else {
+		spool.disown(tmp.Name())
+	}
+	return err
+}
+
+// Close stops the background sweeps of the cache's directories (see CachePolicy.SweepInterval), and
+// writes any pending changes to the index of the cache on disk (see CachePolicy.Dir), first waiting for
+// the index to be loaded if that's still in progress. Call it once the Group is no longer needed, or
+// before the process exits so the cache is reused in full after a restart. Close does nothing when the
+// cache isn't on disk.
+//
+// Close also allows another Group to use the cache's directory, such as a Group replacing this one.
+// The Group should not be used after Close.
+func (g *KeyedGroup[K]) Close() error {
+	g.mu.Lock()
+	loaded := g.cacheLoaded
+	spool := g.spool
+	g.mu.Unlock()
+	if loaded == nil {
+		return nil
+	}
+	spool.stop()
+	<-loaded
+
+	g.mu.Lock()
+	if g.indexTimer != nil {
+		g.indexTimer.Stop()
+		g.indexTimer = nil
+	}
+	g.mu.Unlock()
+	err := g.writeCacheIndex()
+	g.releaseCacheDir()
+	return err
+}
+
+// loadCacheIndex populates the cache from the index on disk, removing any files which are not part
+// of the index or no longer match it. It runs in the background, as verifying the files means reading
+// them in full: streams are added to the cache as they are verified, and calls for the keys of
+// streams which haven't been verified yet are treated as misses.
+func (g *KeyedGroup[K]) loadCacheIndex() {
+	defer func() {
+		g.mu.Lock()
+		defer g.mu.Unlock()
+		close(g.cacheLoaded)
+		g.cacheIndexChanged()
+	}()
+
+	dir := g.Cache.Dir
+	index := cacheIndex{}
+	if b, err := os.ReadFile(filepath.Join(dir, cacheIndexName)); err == nil {
+		if json.Unmarshal(b, &index) != nil || index.Version != cacheIndexVersion {
+			index = cacheIndex{} // start over rather than trust a corrupt or unknown index
+		}
+	}
+
+	// Claim the files up front, so they aren't swept while the others are verified
+	entries := make([]cacheIndexEntry, 0, len(index.Entries))
+	for _, ie := range index.Entries {
+		if _, ok := spoolOwner(ie.File); !ok || filepath.Base(ie.File) != ie.File || !strings.HasSuffix(ie.File, cacheSuffix) {
+			continue // not a file we wrote
+		}
+		g.spool.own(filepath.Join(dir, ie.File))
+		entries = append(entries, ie)
+	}
+
+	for _, ie := range entries {
+		file := filepath.Join(dir, ie.File)
+		var key K
+		if json.Unmarshal(ie.Key, &key) != nil || !g.loadCacheEntry(key, file, ie) {
+			g.spool.remove(file)
+		}
+	}
+
+	// Anything else we wrote is expired, incomplete, or was left behind by a crash
+	g.spool.sweep()
+	if g.Cache.SweepInterval <= 0 {
+		// Files named after this process were left alone if they were recent, so look again later
+		g.spool.sweepAfter(spoolGracePeriod)
+	}
+}
+
+// loadCacheEntry verifies the file of an entry in the index, adding it to the cache for key if it's
+// intact and still wanted.
+func (g *KeyedGroup[K]) loadCacheEntry(key K, file string, ie cacheIndexEntry) bool {
+	if !time.Now().Before(ie.Expires.Add(g.Cache.StaleWhileRevalidate)) {
+		return false
+	}
+	if !verifyCacheFile(file, ie.Size, ie.Digest) {
+		return false
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if _, ok := g.cache[key]; ok {
+		return false // the key was cached again while the file was verified
+	}
+	e := &cacheEntry{
+		file:    file,
+		size:    ie.Size,
+		digest:  ie.Digest,
+		expires: ie.Expires,
+		refs: newRefCount(1, 0, func() {
+			g.spool.remove(file)
+		}),
+	}
+	if len(ie.Meta) > 0 {
+		e.meta = ie.Meta
+	}
+	g.storeCache(key, e)
+	return true
+}
+
+// verifyCacheFile reports whether the file has the given size and hex-encoded SHA-256 digest.
+func verifyCacheFile(file string, size int64, digest string) bool {
+	f, err := os.Open(file)
+	if err != nil {
+		return false
+	}
+	//goland:noinspection GoUnhandledErrorResult
+	defer f.Close()
+	h := sha256.New()
+	n, err := io.Copy(h, f)
+	return err == nil && n == size && hex.EncodeToString(h.Sum(nil)) == digest
+}
+
+// cachedFile reads a stream cached on disk. The *os.File is embedded so io.Copy can use sendfile or
+// similar when writing it out.
+type cachedFile struct {
+	*os.File
+	release     func() // called once the file is closed, allowing it to be removed
+	releaseOnce sync.Once
+}
+
+func (f *cachedFile) Close() error {
+	err := f.File.Close()
+	f.releaseOnce.Do(f.release)
+	return err
+}
+
+func (f *cachedFile) Read(p []byte) (int, error) {
+	n, err := f.File.Read(p)
+	return n, cachedFileError(err)
+}
+
+func (f *cachedFile) WriteTo(w io.Writer) (int64, error) {
+	// Dev note: io.Copy hands the *os.File itself to w if it implements io.ReaderFrom.
+	n, err := io.Copy(w, f.File)
+	return n, cachedFileError(err)
+}
+
+func (f *cachedFile) Seek(offset int64, whence int) (int64, error) {
+	n, err := f.File.Seek(offset, whence)
+	return n, cachedFileError(err)
+}
+
+// cachedFileError reports reads of a closed file as ErrReaderClosed, like the Group's other readers.
+func cachedFileError(err error) error {
+	if errors.Is(err, os.ErrClosed) {
+		return ErrReaderClosed
+	}
+	return err
+}
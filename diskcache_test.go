@@ -0,0 +1,236 @@
+package sfstreams
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func cacheFiles(t *testing.T, dir string) []string {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := make([]string, 0)
+	for _, e := range entries {
+		if e.Name() != cacheIndexName {
+			names = append(names, e.Name())
+		}
+	}
+	return names
+}
+
+// loadCache starts g, and waits for it to load the cache from disk.
+func loadCache(g *Group) {
+	g.mu.Lock()
+	g.init()
+	loaded := g.cacheLoaded
+	g.mu.Unlock()
+	<-loaded
+}
+
+func TestDiskCacheSurvivesRestart(t *testing.T) {
+	dir := t.TempDir()
+	b := make([]byte, 16*1024)
+	_, _ = rand.Read(b)
+	callCount := 0
+	workFn := func() (io.ReadCloser, testMeta, error) {
+		callCount++
+		return io.NopCloser(bytes.NewReader(b)), testMeta{ContentType: "text/plain", ETag: "abc"}, nil
+	}
+
+	g := &Group{Cache: &CachePolicy{TTL: time.Minute, Dir: dir}}
+	r, _, err, _ := DoWithMeta(g, "key", workFn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = io.Copy(io.Discard, r)
+	_ = r.Close()
+	time.Sleep(10 * time.Millisecond) // let the flight finish caching
+
+	files := cacheFiles(t, dir)
+	if len(files) != 1 || !strings.HasSuffix(files[0], cacheSuffix) {
+		t.Fatalf("Expected one cached file, got %v", files)
+	}
+
+	if err = g.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// A new Group using the same directory picks up the cached stream
+	g = &Group{Cache: &CachePolicy{TTL: time.Minute, Dir: dir}}
+	loadCache(g)
+	//goland:noinspection GoUnhandledErrorResult
+	defer g.Close()
+	r, meta, err, shared := DoWithMeta(g, "key", workFn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	//goland:noinspection GoUnhandledErrorResult
+	defer r.Close()
+	if !shared {
+		t.Error("Expected the cached stream to be shared")
+	}
+	if meta.ContentType != "text/plain" || meta.ETag != "abc" {
+		t.Errorf("Expected the metadata to survive a restart, got %+v", meta)
+	}
+	res, _ := io.ReadAll(r)
+	if !bytes.Equal(res, b) {
+		t.Error("Cached bytes do not match source")
+	}
+	if callCount != 1 {
+		t.Errorf("Expected 1 call, got %d", callCount)
+	}
+}
+
+func TestDiskCacheRemovesBadFiles(t *testing.T) {
+	dir := t.TempDir()
+	workFn := func(key string) func(ctx context.Context) (io.ReadCloser, error) {
+		return func(ctx context.Context) (io.ReadCloser, error) {
+			return io.NopCloser(bytes.NewReader([]byte("stream for " + key))), nil
+		}
+	}
+
+	g := &Group{Cache: &CachePolicy{TTL: time.Minute, Dir: dir}}
+	for _, key := range []string{"good", "corrupt"} {
+		readResult(t, g.DoResult(context.Background(), key, workFn(key)))
+	}
+	time.Sleep(10 * time.Millisecond) // let the flights finish caching
+	if err := g.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Simulate a crash partway through a spool, and a file which was damaged
+	crashed := spoolPrefix + strconv.Itoa(deadPID(t)) + "-"
+	writeOldFile(t, dir, crashed+"partial"+spoolSuffix)
+	writeOldFile(t, dir, crashed+"orphan"+cacheSuffix)
+	writeOldFile(t, dir, "unrelated.txt")
+	g.mu.Lock()
+	corrupt := g.cache["corrupt"].file
+	g.mu.Unlock()
+	if err := os.WriteFile(corrupt, []byte("stream for corrupt!"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	g = &Group{Cache: &CachePolicy{TTL: time.Minute, Dir: dir}}
+	loadCache(g)
+	//goland:noinspection GoUnhandledErrorResult
+	defer g.Close()
+	res := g.DoResult(context.Background(), "good", workFn("good"))
+	if !res.Cached {
+		t.Error("Expected the intact stream to be reused")
+	}
+	readResult(t, res)
+	res = g.DoResult(context.Background(), "corrupt", workFn("corrupt"))
+	if res.Cached {
+		t.Error("Expected the damaged stream to be discarded")
+	}
+	if b := readResult(t, res); string(b) != "stream for corrupt" {
+		t.Errorf("Unexpected stream: %s", b)
+	}
+	time.Sleep(10 * time.Millisecond)
+
+	files := cacheFiles(t, dir)
+	if len(files) != 3 {
+		t.Errorf("Expected 2 cached files and the unrelated file, got %v", files)
+	}
+	for _, name := range files {
+		if strings.HasPrefix(name, crashed) {
+			t.Errorf("Expected %s to be removed", name)
+		}
+	}
+}
+
+func TestDiskCacheExpired(t *testing.T) {
+	dir := t.TempDir()
+	workFn := func(ctx context.Context) (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader([]byte("hello"))), nil
+	}
+
+	g := &Group{Cache: &CachePolicy{TTL: 20 * time.Millisecond, Dir: dir}}
+	//goland:noinspection GoUnhandledErrorResult
+	defer g.Close()
+	readResult(t, g.DoResult(context.Background(), "key", workFn))
+	time.Sleep(10 * time.Millisecond)
+	if len(cacheFiles(t, dir)) != 1 {
+		t.Fatal("Expected a cached file")
+	}
+
+	time.Sleep(30 * time.Millisecond)
+	if files := cacheFiles(t, dir); len(files) != 0 {
+		t.Errorf("Expected the expired file to be removed, got %v", files)
+	}
+}
+
+func TestDiskCacheIndexBatched(t *testing.T) {
+	dir := t.TempDir()
+	workFn := func(ctx context.Context) (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader([]byte("hello"))), nil
+	}
+	readIndex := func() cacheIndex {
+		index := cacheIndex{}
+		if b, err := os.ReadFile(filepath.Join(dir, cacheIndexName)); err == nil {
+			if err = json.Unmarshal(b, &index); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return index
+	}
+
+	g := &Group{Cache: &CachePolicy{TTL: time.Minute, Dir: dir}}
+	loadCache(g)
+	for _, key := range []string{"a", "b", "c"} {
+		readResult(t, g.DoResult(context.Background(), key, workFn))
+	}
+	time.Sleep(10 * time.Millisecond) // let the flights finish caching
+	if index := readIndex(); len(index.Entries) != 0 {
+		t.Errorf("Expected the index to not be written yet, got %d entries", len(index.Entries))
+	}
+
+	if err := g.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if index := readIndex(); len(index.Entries) != 3 {
+		t.Errorf("Expected 3 entries in the index, got %d", len(index.Entries))
+	}
+}
+
+func TestDiskCacheDirInUse(t *testing.T) {
+	dir := t.TempDir()
+	workFn := func(ctx context.Context) (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader([]byte("hello"))), nil
+	}
+
+	g := &Group{Cache: &CachePolicy{TTL: time.Minute, Dir: dir}}
+	loadCache(g)
+
+	// Another Group can't use the directory until the first is closed
+	other := &Group{Cache: &CachePolicy{TTL: time.Minute, Dir: dir}}
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Error("Expected a panic for a directory in use")
+			}
+		}()
+		other.Prefetch("key", func() (io.ReadCloser, error) {
+			return workFn(context.Background())
+		})
+	}()
+
+	if err := g.Close(); err != nil {
+		t.Fatal(err)
+	}
+	other = &Group{Cache: &CachePolicy{TTL: time.Minute, Dir: dir}}
+	loadCache(other)
+	//goland:noinspection GoUnhandledErrorResult
+	defer other.Close()
+	readResult(t, other.DoResult(context.Background(), "key", workFn))
+}
@@ -0,0 +1,55 @@
+package sfstreams
+
+import (
+	"time"
+)
+
+// ErrorCachePolicy describes which work function errors are remembered for a key, and for how long.
+// While an error is remembered, calls for the key receive it immediately instead of calling the work
+// function again. This protects the upstream from repeated requests for missing or forbidden
+// resources.
+type ErrorCachePolicy struct {
+	// TTL is how long an error is remembered for. Values less than or equal to zero disable caching.
+	TTL time.Duration
+
+	// Cacheable reports whether err, as returned by the work function, should be remembered. When nil,
+	// all errors are remembered. Typically, this only accepts permanent errors such as "not found".
+	Cacheable func(err error) bool
+}
+
+func (p *ErrorCachePolicy) cacheable(err error) bool {
+	if p == nil || p.TTL <= 0 || err == nil {
+		return false
+	}
+	return p.Cacheable == nil || p.Cacheable(err)
+}
+
+// cachedError is an error remembered for a key.
+type cachedError struct {
+	err error
+}
+
+// cachedError returns the error remembered for key, if any. g.mu must be held.
+func (g *KeyedGroup[K]) cachedError(key K) error {
+	if c, ok := g.errCache[key]; ok {
+		return c.err
+	}
+	return nil
+}
+
+// cacheError remembers err for key if the ErrorCache policy allows it, where fnErr is the error
+// returned by the work function and err is the error given to callers. g.mu must be held.
+func (g *KeyedGroup[K]) cacheError(key K, fnErr error, err error) {
+	if !g.ErrorCache.cacheable(fnErr) {
+		return
+	}
+	c := &cachedError{err: err}
+	g.errCache[key] = c
+	time.AfterFunc(g.ErrorCache.TTL, func() {
+		g.mu.Lock()
+		defer g.mu.Unlock()
+		if g.errCache[key] == c {
+			delete(g.errCache, key)
+		}
+	})
+}
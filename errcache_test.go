@@ -0,0 +1,87 @@
+package sfstreams
+
+import (
+	"errors"
+	"io"
+	"testing"
+	"time"
+)
+
+func TestErrorCache(t *testing.T) {
+	notFound := errors.New("not found")
+	callCount := 0
+	workFn := func() (io.ReadCloser, error) {
+		callCount++
+		return nil, notFound
+	}
+
+	g := &Group{ErrorCache: &ErrorCachePolicy{TTL: 50 * time.Millisecond}}
+	for i := 0; i < 3; i++ {
+		r, err, shared := g.Do("key", workFn)
+		if !errors.Is(err, notFound) {
+			t.Errorf("Expected %v, got %v", notFound, err)
+		}
+		if r != nil {
+			t.Error("Expected no reader")
+		}
+		if shared != (i > 0) {
+			t.Errorf("Expected remembered errors to be shared, got %v for call %d", shared, i)
+		}
+	}
+	if callCount != 1 {
+		t.Errorf("Expected 1 call, got %d", callCount)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	_, err, _ := g.Do("key", workFn)
+	if !errors.Is(err, notFound) {
+		t.Errorf("Expected %v, got %v", notFound, err)
+	}
+	if callCount != 2 {
+		t.Errorf("Expected 2 calls after the TTL, got %d", callCount)
+	}
+}
+
+func TestErrorCacheCacheable(t *testing.T) {
+	notFound := errors.New("not found")
+	transient := errors.New("transient")
+	callCount := 0
+	fnErr := transient
+	workFn := func() (io.ReadCloser, error) {
+		callCount++
+		return nil, fnErr
+	}
+
+	g := &Group{ErrorCache: &ErrorCachePolicy{
+		TTL: time.Minute,
+		Cacheable: func(err error) bool {
+			return errors.Is(err, notFound)
+		},
+	}}
+	_, _, _ = g.Do("key", workFn)
+	_, _, _ = g.Do("key", workFn)
+	if callCount != 2 {
+		t.Errorf("Expected transient errors to not be remembered, got %d calls", callCount)
+	}
+
+	fnErr = notFound
+	_, _, _ = g.Do("key", workFn)
+	_, err, _ := g.Do("key", workFn)
+	if !errors.Is(err, notFound) {
+		t.Errorf("Expected %v, got %v", notFound, err)
+	}
+	if callCount != 3 {
+		t.Errorf("Expected 3 calls, got %d", callCount)
+	}
+
+	// Forgetting the key forgets the error too
+	g.Forget("key")
+	fnErr = nil
+	_, err, _ = g.Do("key", workFn)
+	if err != nil {
+		t.Errorf("Expected no error after Forget, got %v", err)
+	}
+	if callCount != 4 {
+		t.Errorf("Expected 4 calls, got %d", callCount)
+	}
+}
@@ -0,0 +1,82 @@
+package sfstreams
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+)
+
+var (
+	// ErrForgotten is returned to callers waiting on a flight which was forgotten (see KeyedGroup.Forget)
+	// before its work function returned. The work function's stream, if any, is closed.
+	ErrForgotten = errors.New("sfstreams: flight was forgotten")
+
+	// ErrAborted is returned when a flight or subscription was stopped locally before its stream was
+	// complete, such as when every reader of it was closed. The source did not fail.
+	ErrAborted = errors.New("sfstreams: flight was aborted")
+
+	// ErrReaderClosed is returned when reading from or seeking a reader after it has been closed. It
+	// wraps io.ErrClosedPipe, so errors.Is(err, io.ErrClosedPipe) also reports true.
+	ErrReaderClosed = fmt.Errorf("sfstreams: reader is closed: %w", io.ErrClosedPipe)
+)
+
+// WorkError is returned by Do (and similar) when the work function returns an error. The error is
+// shared by every caller of the flight.
+type WorkError struct {
+	// Key is the key the work function was called for.
+	Key any
+
+	// Err is the error returned by the work function, after any retries.
+	Err error
+}
+
+func (e *WorkError) Error() string {
+	return fmt.Sprintf("sfstreams: work function for key \"%v\" failed: %v", e.Key, e.Err)
+}
+
+func (e *WorkError) Unwrap() error {
+	return e.Err
+}
+
+// SourceError is returned by readers when the stream returned by the work function fails partway
+// through, after any resumes (see DoResumable).
+type SourceError struct {
+	// Key is the key the stream was shared for.
+	Key any
+
+	// Err is the error returned by the stream.
+	Err error
+
+	// BytesDelivered is how many bytes of the stream were delivered before it failed. For DoRange,
+	// this is relative to the start of the requested range.
+	BytesDelivered int64
+}
+
+func (e *SourceError) Error() string {
+	return fmt.Sprintf("sfstreams: source for key \"%v\" failed after %d bytes: %v", e.Key, e.BytesDelivered, e.Err)
+}
+
+func (e *SourceError) Unwrap() error {
+	return e.Err
+}
+
+// workError wraps an error returned by a work function, if there is one.
+func workError(key any, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &WorkError{Key: key, Err: err}
+}
+
+// copyError classifies an error which stopped copying a source to its readers, where ctx is the
+// context of the flight (or subscription) doing the copy.
+func copyError(ctx context.Context, key any, err error, delivered int64) error {
+	if err == nil {
+		return nil
+	}
+	if ctx.Err() != nil || errors.Is(err, ErrAborted) {
+		return ErrAborted
+	}
+	return &SourceError{Key: key, Err: err, BytesDelivered: delivered}
+}
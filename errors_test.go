@@ -0,0 +1,128 @@
+package sfstreams
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"io"
+	"testing"
+	"time"
+)
+
+func TestWorkError(t *testing.T) {
+	expectedErr := errors.New("this is expected")
+	g := new(Group)
+	_, err, _ := g.Do("key", func() (io.ReadCloser, error) {
+		return nil, expectedErr
+	})
+
+	var workErr *WorkError
+	if !errors.As(err, &workErr) {
+		t.Fatalf("Expected a WorkError, got %v", err)
+	}
+	if workErr.Key != "key" {
+		t.Errorf("Expected key \"key\", got %v", workErr.Key)
+	}
+	if !errors.Is(err, expectedErr) {
+		t.Errorf("Expected %v, got %v", expectedErr, err)
+	}
+}
+
+func TestSourceError(t *testing.T) {
+	b := make([]byte, 16*1024)
+	_, _ = rand.Read(b)
+	dropErr := errors.New("connection dropped")
+
+	for _, useSeekers := range []bool{false, true} {
+		g := &Group{UseSeekers: useSeekers}
+		r, err, _ := g.Do("key", func() (io.ReadCloser, error) {
+			return nopSeekCloser(&flakySeeker{flakyReader{r: bytes.NewReader(b), limit: 5000, err: dropErr}}), nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		c, err := io.Copy(io.Discard, r)
+		_ = r.Close()
+
+		var sourceErr *SourceError
+		if !errors.As(err, &sourceErr) {
+			t.Fatalf("Expected a SourceError with seekers=%v, got %v", useSeekers, err)
+		}
+		if sourceErr.Key != "key" {
+			t.Errorf("Expected key \"key\", got %v", sourceErr.Key)
+		}
+		if sourceErr.BytesDelivered != c || c != 5000 {
+			t.Errorf("Expected 5000 bytes delivered, read %d and got %d", c, sourceErr.BytesDelivered)
+		}
+		if !errors.Is(err, dropErr) {
+			t.Errorf("Expected %v, got %v", dropErr, err)
+		}
+	}
+}
+
+// flakySeeker is a flakyReader which pretends to support seeking, for use with UseSeekers.
+type flakySeeker struct {
+	flakyReader
+}
+
+func (f *flakySeeker) Seek(offset int64, whence int) (int64, error) {
+	return f.r.(io.Seeker).Seek(offset, whence)
+}
+
+func TestErrReaderClosed(t *testing.T) {
+	for _, useSeekers := range []bool{false, true} {
+		_, _, src := makeStream()
+		g := &Group{UseSeekers: useSeekers}
+		r, err, _ := g.Do("key", func() (io.ReadCloser, error) {
+			return src, nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = r.Close()
+		_, err = r.Read(make([]byte, 10))
+		if !errors.Is(err, ErrReaderClosed) {
+			t.Errorf("Expected ErrReaderClosed with seekers=%v, got %v", useSeekers, err)
+		}
+		if !errors.Is(err, io.ErrClosedPipe) {
+			t.Errorf("Expected ErrReaderClosed to be io.ErrClosedPipe, got %v", err)
+		}
+	}
+}
+
+func TestErrForgotten(t *testing.T) {
+	gate := make(chan struct{})
+	g := new(Group)
+	ch := g.DoChan("key", func() (io.ReadCloser, error) {
+		<-gate
+		_, _, src := makeStream()
+		return src, nil
+	})
+	time.Sleep(20 * time.Millisecond)
+	g.Forget("key")
+	close(gate)
+
+	res := <-ch
+	if !errors.Is(res.Err, ErrForgotten) {
+		t.Errorf("Expected ErrForgotten, got %v", res.Err)
+	}
+	if res.Reader != nil {
+		t.Error("Expected no reader")
+	}
+}
+
+func TestRangeErrorKey(t *testing.T) {
+	expectedErr := errors.New("this is expected")
+	g := new(Group)
+	_, err, _ := g.DoRange("key", 100, 200, func(offset int64, length int64) (io.ReadCloser, error) {
+		return nil, expectedErr
+	})
+
+	var workErr *WorkError
+	if !errors.As(err, &workErr) {
+		t.Fatalf("Expected a WorkError, got %v", err)
+	}
+	if workErr.Key != "key" {
+		t.Errorf("Expected key \"key\", got %v", workErr.Key)
+	}
+}
@@ -0,0 +1,53 @@
+package sfstreams
+
+import (
+	"strings"
+)
+
+// ForgetFunc runs Forget for every key which match reports true for, such as every key belonging to a
+// bucket or user which has changed. Only keys the Group currently knows about are considered: keys of
+// in-flight calls, ranges, broadcasts, subscriptions, remembered errors, and cached streams.
+//
+// match is called while the Group is locked, so must not call back into the Group.
+func (g *KeyedGroup[K]) ForgetFunc(match func(key K) bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	keys := make(map[K]bool)
+	collect := func(key K) {
+		if _, seen := keys[key]; !seen {
+			keys[key] = match(key)
+		}
+	}
+	for key := range g.flights {
+		collect(key)
+	}
+	for key := range g.broadcasts {
+		collect(key)
+	}
+	for key := range g.subscriptions {
+		collect(key)
+	}
+	for key := range g.errCache {
+		collect(key)
+	}
+	for key := range g.cache {
+		collect(key)
+	}
+	for key := range g.ranges {
+		collect(key)
+	}
+
+	for key, matched := range keys {
+		if matched {
+			g.forget(key)
+		}
+	}
+}
+
+// ForgetPrefix runs Forget for every key starting with prefix. See KeyedGroup.ForgetFunc.
+func ForgetPrefix[K ~string](g *KeyedGroup[K], prefix K) {
+	g.ForgetFunc(func(key K) bool {
+		return strings.HasPrefix(string(key), string(prefix))
+	})
+}
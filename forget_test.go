@@ -0,0 +1,157 @@
+package sfstreams
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestForgetPrefix(t *testing.T) {
+	calls := make(map[string]int)
+	workFn := func(key string) func() (io.ReadCloser, error) {
+		return func() (io.ReadCloser, error) {
+			calls[key]++
+			return io.NopCloser(bytes.NewReader([]byte(key))), nil
+		}
+	}
+	read := func(g *Group, key string) {
+		r, err, _ := g.Do(key, workFn(key))
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, _ = io.Copy(io.Discard, r)
+		_ = r.Close()
+		time.Sleep(10 * time.Millisecond) // let the flight finish caching
+	}
+
+	g := &Group{Cache: &CachePolicy{TTL: time.Minute}}
+	keys := []string{"a/1", "a/2", "b/1"}
+	for _, key := range keys {
+		read(g, key)
+	}
+	ForgetPrefix(g, "a/")
+	for _, key := range keys {
+		read(g, key)
+	}
+
+	expected := map[string]int{"a/1": 2, "a/2": 2, "b/1": 1}
+	for key, count := range expected {
+		if calls[key] != count {
+			t.Errorf("Expected %d calls for %s, got %d", count, key, calls[key])
+		}
+	}
+}
+
+func TestForgetFuncInFlight(t *testing.T) {
+	gate := make(chan struct{})
+	g := new(Group)
+	chA := g.DoChan("a/1", func() (io.ReadCloser, error) {
+		<-gate
+		_, _, src := makeStream()
+		return src, nil
+	})
+	chB := g.DoChan("b/1", func() (io.ReadCloser, error) {
+		<-gate
+		_, _, src := makeStream()
+		return src, nil
+	})
+	time.Sleep(20 * time.Millisecond)
+	g.ForgetFunc(func(key string) bool {
+		return strings.HasPrefix(key, "a/")
+	})
+	close(gate)
+
+	res := <-chA
+	if !errors.Is(res.Err, ErrForgotten) {
+		t.Errorf("Expected ErrForgotten, got %v", res.Err)
+	}
+	res = <-chB
+	if res.Err != nil {
+		t.Fatal(res.Err)
+	}
+	_ = res.Reader.Close()
+}
+
+func TestForgetFuncFullFlights(t *testing.T) {
+	gate := make(chan struct{})
+	workFn := func() (io.ReadCloser, error) {
+		<-gate
+		_, _, src := makeStream()
+		return src, nil
+	}
+
+	// Each caller gets its own flight, so the first is no longer the one later callers join
+	g := &Group{MaxWaitersPerFlight: 1}
+	ch1 := g.DoChan("a/1", workFn)
+	ch2 := g.DoChan("a/1", workFn)
+	time.Sleep(20 * time.Millisecond)
+	ForgetPrefix(g, "a/")
+	close(gate)
+
+	for _, ch := range []<-chan ReaderResult{ch1, ch2} {
+		res := <-ch
+		if !errors.Is(res.Err, ErrForgotten) {
+			t.Errorf("Expected ErrForgotten, got %v", res.Err)
+		}
+	}
+}
+
+func TestForgetFuncRange(t *testing.T) {
+	b, fn, getCalls, gate := makeRangeSource(4096)
+
+	g := new(Group)
+	errCh := make(chan error, 1)
+	go func() {
+		r, err, _ := g.DoRange("a/1", 100, 200, fn)
+		if r != nil {
+			_ = r.Close()
+		}
+		errCh <- err
+	}()
+	for len(getCalls()) < 1 {
+		time.Sleep(time.Millisecond)
+	}
+	ForgetPrefix(g, "a/")
+	close(gate)
+
+	if err := <-errCh; !errors.Is(err, ErrForgotten) {
+		t.Errorf("Expected ErrForgotten, got %v", err)
+	}
+
+	// Later callers start a new flight rather than joining the forgotten one
+	res := readRange(t, g, "a/1", 100, 200, fn)
+	if !bytes.Equal(res, b[100:300]) {
+		t.Error("Range bytes do not match source")
+	}
+	if calls := getCalls(); len(calls) != 2 {
+		t.Errorf("Expected 2 calls, got %v", calls)
+	}
+}
+
+func TestShardedGroupForgetPrefix(t *testing.T) {
+	callCount := 0
+	workFn := func() (io.ReadCloser, error) {
+		callCount++
+		return io.NopCloser(bytes.NewReader([]byte("hello"))), nil
+	}
+
+	g := NewShardedGroup(4, func() *Group {
+		return &Group{Cache: &CachePolicy{TTL: time.Minute}}
+	})
+	for i := 0; i < 2; i++ {
+		r, err, _ := g.Do("a/1", workFn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, _ = io.Copy(io.Discard, r)
+		_ = r.Close()
+		time.Sleep(10 * time.Millisecond)
+		g.ForgetPrefix("a/")
+	}
+	if callCount != 2 {
+		t.Errorf("Expected 2 calls, got %d", callCount)
+	}
+}
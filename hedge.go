@@ -0,0 +1,137 @@
+package sfstreams
+
+import (
+	"context"
+	"io"
+	"time"
+)
+
+// WithHedge overrides the KeyedGroup.HedgeAfter threshold for the call. Zero disables hedging.
+func WithHedge(after time.Duration) CallOption {
+	return func(o *callOptions) {
+		o.hedgeAfter = after
+	}
+}
+
+type hedgeResult struct {
+	i   int
+	r   io.ReadCloser
+	err error
+}
+
+// hedge calls fn, starting a second attempt if the first has not produced its first byte within
+// after. The first attempt to produce data is used, and the other attempt's context is cancelled and
+// its stream closed as soon as it is available. An error is only returned once all started attempts
+// have failed.
+func hedge(ctx context.Context, fn func(ctx context.Context) (io.ReadCloser, error), after time.Duration) (io.ReadCloser, error) {
+	if after <= 0 {
+		return fn(ctx)
+	}
+
+	results := make(chan hedgeResult, 2)
+	cancels := make([]context.CancelFunc, 0, 2)
+	metas := make([]*metaBox, 0, 2)
+	start := func() {
+		attemptCtx, cancel := context.WithCancel(ctx)
+		i := len(cancels)
+		cancels = append(cancels, cancel)
+
+		// Each attempt gets its own metadata, so the losing attempt can't replace the winner's
+		meta := new(metaBox)
+		attemptCtx = context.WithValue(attemptCtx, metaKey{}, meta)
+		metas = append(metas, meta)
+
+		go func() {
+			r, err := fn(attemptCtx)
+			if err == nil && r != nil {
+				r, err = primeReader(r)
+			}
+			results <- hedgeResult{i: i, r: r, err: err}
+		}()
+	}
+
+	start()
+	received := 0
+	timer := time.NewTimer(after)
+	defer timer.Stop()
+
+	var res hedgeResult
+	for {
+		select {
+		case <-timer.C:
+			start()
+			continue
+		case res = <-results:
+			received++
+		}
+		// Failures are only returned once every started attempt has failed
+		if res.err == nil || received == len(cancels) {
+			break
+		}
+	}
+
+	SetMeta(ctx, metas[res.i].get())
+
+	// Cancel the losing attempt and clean up after it, if there is one. The winning attempt's context
+	// is cancelled along with ctx.
+	for i, cancel := range cancels {
+		if i != res.i || res.err != nil {
+			cancel()
+		}
+	}
+	if received < len(cancels) {
+		go func() {
+			loser := <-results
+			if loser.r != nil {
+				_ = loser.r.Close()
+			}
+		}()
+	}
+	return res.r, res.err
+}
+
+// primeReader reads the first bytes of r, returning a reader which produces the same stream as r
+// would have. Readers which can seek are rewound rather than wrapped so they remain seekable.
+func primeReader(r io.ReadCloser) (io.ReadCloser, error) {
+	buf := make([]byte, 512)
+	n := 0
+	var err error
+	for n == 0 && err == nil {
+		n, err = r.Read(buf)
+	}
+	if err != nil && err != io.EOF {
+		_ = r.Close()
+		return nil, err
+	}
+
+	if rs, ok := r.(io.ReadSeeker); ok {
+		if _, seekErr := rs.Seek(int64(-n), io.SeekCurrent); seekErr == nil {
+			return r, nil
+		}
+	}
+	return &primedReader{buf: buf[:n], r: r, err: err}, nil
+}
+
+// primedReader returns the already read bytes of a stream before continuing with the stream itself.
+type primedReader struct {
+	io.ReadCloser
+	buf []byte
+	r   io.ReadCloser
+	err error // the error returned alongside buf, if any
+}
+
+func (p *primedReader) Read(b []byte) (int, error) {
+	if len(p.buf) > 0 {
+		n := copy(b, p.buf)
+		p.buf = p.buf[n:]
+		return n, nil
+	}
+	if p.err != nil {
+		return 0, p.err
+	}
+	return p.r.Read(b)
+}
+
+func (p *primedReader) Close() error {
+	return p.r.Close()
+}
@@ -0,0 +1,145 @@
+package sfstreams
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"io"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type closeTracker struct {
+	io.Reader
+	closed *atomic.Bool
+}
+
+func (c *closeTracker) Close() error {
+	c.closed.Store(true)
+	return nil
+}
+
+func TestHedgeSlowFirstAttempt(t *testing.T) {
+	b := make([]byte, 16*1024)
+	_, _ = rand.Read(b)
+
+	mu := new(sync.Mutex)
+	callCount := 0
+	slowClosed := new(atomic.Bool)
+	workFn := func() (io.ReadCloser, error) {
+		mu.Lock()
+		callCount++
+		call := callCount
+		mu.Unlock()
+		if call == 1 {
+			time.Sleep(200 * time.Millisecond)
+			return &closeTracker{Reader: bytes.NewReader(b), closed: slowClosed}, nil
+		}
+		return io.NopCloser(bytes.NewReader(b)), nil
+	}
+
+	g := new(Group)
+	g.HedgeAfter = 20 * time.Millisecond
+	start := time.Now()
+	r, err, _ := g.Do("key", workFn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if time.Since(start) >= 200*time.Millisecond {
+		t.Error("Expected the hedged attempt to be used")
+	}
+
+	//goland:noinspection GoUnhandledErrorResult
+	defer r.Close()
+	res, _ := io.ReadAll(r)
+	if !bytes.Equal(res, b) {
+		t.Error("Read bytes do not match source")
+	}
+
+	time.Sleep(300 * time.Millisecond)
+	mu.Lock()
+	defer mu.Unlock()
+	if callCount != 2 {
+		t.Errorf("Expected 2 calls, got %d", callCount)
+	}
+	if !slowClosed.Load() {
+		t.Error("Expected the losing attempt to be closed")
+	}
+}
+
+func TestHedgeFastFirstAttempt(t *testing.T) {
+	key, expectedBytes, src := makeStream()
+
+	callCount := 0
+	workFn := func() (io.ReadCloser, error) {
+		callCount++
+		return src, nil
+	}
+
+	g := new(Group)
+	r, err, _ := g.Do(key, workFn, WithHedge(time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//goland:noinspection GoUnhandledErrorResult
+	defer r.Close()
+	c, _ := io.Copy(io.Discard, r)
+	if c != expectedBytes {
+		t.Errorf("Read %d bytes but expected %d", c, expectedBytes)
+	}
+	if callCount != 1 {
+		t.Errorf("Expected 1 call, got %d", callCount)
+	}
+}
+
+func TestHedgeFirstAttemptFails(t *testing.T) {
+	key, expectedBytes, src := makeStream()
+	slowErr := errors.New("slow failure")
+
+	mu := new(sync.Mutex)
+	callCount := 0
+	workFn := func() (io.ReadCloser, error) {
+		mu.Lock()
+		callCount++
+		call := callCount
+		mu.Unlock()
+		if call == 1 {
+			time.Sleep(50 * time.Millisecond)
+			return nil, slowErr
+		}
+		time.Sleep(100 * time.Millisecond)
+		return src, nil
+	}
+
+	g := new(Group)
+	g.HedgeAfter = 10 * time.Millisecond
+	r, err, _ := g.Do(key, workFn)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//goland:noinspection GoUnhandledErrorResult
+	defer r.Close()
+	c, _ := io.Copy(io.Discard, r)
+	if c != expectedBytes {
+		t.Errorf("Read %d bytes but expected %d", c, expectedBytes)
+	}
+}
+
+func TestPrimeReaderKeepsSeeker(t *testing.T) {
+	_, _, src := makeStream()
+	r, err := primeReader(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r != src {
+		t.Fatal("Expected the seekable reader to be returned as-is")
+	}
+	pos, _ := src.(io.Seeker).Seek(0, io.SeekCurrent)
+	if pos != 0 {
+		t.Errorf("Expected the reader to be rewound, but it is at %d", pos)
+	}
+}
@@ -0,0 +1,33 @@
+package sfstreams
+
+import (
+	"time"
+)
+
+// CallOption configures a single call to Do, DoChan, or DoRange. Because calls for the same key share
+// a single flight, options which affect the work function only take effect for the call which starts
+// the flight; calls joining an existing flight use the options of the call which started it.
+type CallOption func(o *callOptions)
+
+type callOptions struct {
+	retry      *RetryPolicy
+	hedgeAfter time.Duration
+}
+
+func (g *KeyedGroup[K]) callOptions(opts []CallOption) *callOptions {
+	o := &callOptions{
+		retry:      g.Retry,
+		hedgeAfter: g.HedgeAfter,
+	}
+	for _, opt := range opts {
+		opt(o)
+	}
+	return o
+}
+
+// WithRetry overrides the KeyedGroup.Retry policy for the call. A nil policy disables retries.
+func WithRetry(policy *RetryPolicy) CallOption {
+	return func(o *callOptions) {
+		o.retry = policy
+	}
+}
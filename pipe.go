@@ -0,0 +1,194 @@
+package sfstreams
+
+import (
+	"errors"
+	"io"
+	"sync"
+)
+
+// pipe is a synchronous in-memory pipe which behaves like io.Pipe, except the read half implements
+// io.WriterTo. This allows each Write to be handed directly to the reader's destination writer
+// instead of being copied into an intermediate buffer first.
+type pipe struct {
+	wrMu sync.Mutex // serializes writes
+	wrCh chan []byte
+	rdCh chan int
+
+	once sync.Once // protects closing done
+	done chan struct{}
+	rerr pipeError
+	werr pipeError
+
+	onCloseRead   func() // called once when the read half is closed, if not nil
+	closeReadOnce sync.Once
+}
+
+type pipeError struct {
+	mu  sync.Mutex
+	err error
+}
+
+func (e *pipeError) Load() error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.err
+}
+
+func (e *pipeError) Store(err error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.err == nil {
+		e.err = err
+	}
+}
+
+// newPipe creates a pipe. onCloseRead, if not nil, is called once when the read half is closed.
+func newPipe(onCloseRead func()) (*pipeReader, *pipeWriter) {
+	p := &pipe{
+		wrCh:        make(chan []byte),
+		rdCh:        make(chan int),
+		done:        make(chan struct{}),
+		onCloseRead: onCloseRead,
+	}
+	return &pipeReader{p: p}, &pipeWriter{p: p}
+}
+
+func (p *pipe) read(b []byte) (int, error) {
+	select {
+	case <-p.done:
+		return 0, p.readCloseError()
+	default:
+	}
+
+	select {
+	case bw := <-p.wrCh:
+		n := copy(b, bw)
+		p.rdCh <- n
+		return n, nil
+	case <-p.done:
+		return 0, p.readCloseError()
+	}
+}
+
+func (p *pipe) writeTo(w io.Writer) (int64, error) {
+	total := int64(0)
+	for {
+		select {
+		case bw := <-p.wrCh:
+			n, err := w.Write(bw)
+			p.rdCh <- n
+			total += int64(n)
+			if err != nil {
+				return total, err
+			}
+		case <-p.done:
+			err := p.readCloseError()
+			if errors.Is(err, io.EOF) {
+				err = nil
+			}
+			return total, err
+		}
+	}
+}
+
+func (p *pipe) write(b []byte) (int, error) {
+	select {
+	case <-p.done:
+		return 0, p.writeCloseError()
+	default:
+		p.wrMu.Lock()
+		defer p.wrMu.Unlock()
+	}
+
+	n := 0
+	for once := true; once || len(b) > 0; once = false {
+		select {
+		case p.wrCh <- b:
+			nw := <-p.rdCh
+			b = b[nw:]
+			n += nw
+		case <-p.done:
+			return n, p.writeCloseError()
+		}
+	}
+	return n, nil
+}
+
+func (p *pipe) closeRead(err error) {
+	if err == nil {
+		err = io.ErrClosedPipe
+	}
+	p.rerr.Store(err)
+	p.once.Do(func() { close(p.done) })
+	if p.onCloseRead != nil {
+		p.closeReadOnce.Do(p.onCloseRead)
+	}
+}
+
+func (p *pipe) closeWrite(err error) {
+	if err == nil {
+		err = io.EOF
+	}
+	p.werr.Store(err)
+	p.once.Do(func() { close(p.done) })
+}
+
+func (p *pipe) readCloseError() error {
+	rerr := p.rerr.Load()
+	if werr := p.werr.Load(); rerr == nil && werr != nil {
+		return werr
+	}
+	return ErrReaderClosed
+}
+
+func (p *pipe) writeCloseError() error {
+	werr := p.werr.Load()
+	if rerr := p.rerr.Load(); werr == nil && rerr != nil {
+		return rerr
+	}
+	return io.ErrClosedPipe
+}
+
+// pipeReader is the read half of a pipe.
+type pipeReader struct {
+	p *pipe
+}
+
+func (r *pipeReader) Read(b []byte) (int, error) {
+	return r.p.read(b)
+}
+
+// WriteTo writes the remaining data to w directly from the writer's buffer, avoiding the intermediate
+// buffer io.Copy would otherwise use.
+func (r *pipeReader) WriteTo(w io.Writer) (int64, error) {
+	return r.p.writeTo(w)
+}
+
+// Close detaches the reader immediately: a blocked Read or WriteTo returns ErrReaderClosed, and the
+// writer's next Write fails so it can stop writing to this reader.
+func (r *pipeReader) Close() error {
+	return r.CloseWithError(nil)
+}
+
+func (r *pipeReader) CloseWithError(err error) error {
+	r.p.closeRead(err)
+	return nil
+}
+
+// pipeWriter is the write half of a pipe.
+type pipeWriter struct {
+	p *pipe
+}
+
+func (w *pipeWriter) Write(b []byte) (int, error) {
+	return w.p.write(b)
+}
+
+func (w *pipeWriter) Close() error {
+	return w.CloseWithError(nil)
+}
+
+func (w *pipeWriter) CloseWithError(err error) error {
+	w.p.closeWrite(err)
+	return nil
+}
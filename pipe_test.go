@@ -0,0 +1,57 @@
+package sfstreams
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+)
+
+func TestPipeWriteTo(t *testing.T) {
+	r, w := newPipe(nil)
+	expected := []byte("hello world, this is a test")
+	go func() {
+		_, _ = w.Write(expected[:5])
+		_, _ = w.Write(expected[5:])
+		_ = w.Close()
+	}()
+
+	buf := new(bytes.Buffer)
+	c, err := r.WriteTo(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c != int64(len(expected)) {
+		t.Errorf("Wrote %d bytes but expected %d", c, len(expected))
+	}
+	if !bytes.Equal(buf.Bytes(), expected) {
+		t.Error("Written bytes do not match")
+	}
+}
+
+func TestPipeWriteToError(t *testing.T) {
+	r, w := newPipe(nil)
+	expectedErr := errors.New("this is expected")
+	go func() {
+		_, _ = w.Write([]byte("partial"))
+		_ = w.CloseWithError(expectedErr)
+	}()
+
+	c, err := r.WriteTo(io.Discard)
+	if !errors.Is(err, expectedErr) {
+		t.Errorf("Expected error %v, got %v", expectedErr, err)
+	}
+	if c != 7 {
+		t.Errorf("Wrote %d bytes but expected 7", c)
+	}
+}
+
+func TestPipeReaderClose(t *testing.T) {
+	r, w := newPipe(nil)
+	_ = r.Close()
+
+	_, err := w.Write([]byte("test"))
+	if !errors.Is(err, io.ErrClosedPipe) {
+		t.Errorf("Expected closed pipe error, got %v", err)
+	}
+}
@@ -0,0 +1,34 @@
+package sfstreams
+
+import (
+	"context"
+	"io"
+	"time"
+)
+
+// Prefetch starts a flight for key without a caller, for example to warm popular resources after a
+// deploy. Callers arriving while the work function runs join the flight as usual. When Cache is set,
+// the stream is copied into the cache even if nobody reads it. Otherwise, a stream which nobody joined
+// to read is closed straight away, so prefetching never holds up the copy or leaves readers behind.
+//
+// Prefetch does nothing if a flight for key is already running, or the key's cached stream is fresh.
+// It also does nothing for live broadcasts (see Broadcast), which have nothing to keep for later
+// callers.
+func (g *KeyedGroup[K]) Prefetch(key K, fn func() (io.ReadCloser, error), opts ...CallOption) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.init()
+	if g.Broadcast {
+		return
+	}
+	e, cached := g.cache[key]
+	if cached && (e.refreshing || time.Now().Before(e.expires)) {
+		return
+	}
+	started := g.refresh(key, func(context.Context) (io.ReadCloser, error) {
+		return fn()
+	}, nil, opts)
+	if cached {
+		e.refreshing = started
+	}
+}
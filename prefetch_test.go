@@ -0,0 +1,156 @@
+package sfstreams
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"io"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestPrefetchJoined(t *testing.T) {
+	key, expectedBytes, src := makeStream()
+
+	mu := new(sync.Mutex)
+	callCount := 0
+	gate := make(chan struct{})
+	workFn := func() (io.ReadCloser, error) {
+		mu.Lock()
+		callCount++
+		mu.Unlock()
+		<-gate
+		return src, nil
+	}
+
+	g := new(Group)
+	g.Prefetch(key, workFn)
+	g.Prefetch(key, workFn) // already running, so ignored
+	time.Sleep(10 * time.Millisecond)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		r, err, shared := g.Do(key, workFn)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		//goland:noinspection GoUnhandledErrorResult
+		defer r.Close()
+		if !shared {
+			t.Error("Expected the prefetched flight to be shared")
+		}
+		c, _ := io.Copy(io.Discard, r)
+		if c != expectedBytes {
+			t.Errorf("Read %d bytes but expected %d", c, expectedBytes)
+		}
+	}()
+	time.Sleep(10 * time.Millisecond)
+	close(gate)
+	<-done
+
+	mu.Lock()
+	defer mu.Unlock()
+	if callCount != 1 {
+		t.Errorf("Expected 1 call, got %d", callCount)
+	}
+}
+
+func TestPrefetchNobodyReads(t *testing.T) {
+	closed := new(atomic.Bool)
+	g := new(Group)
+	g.Prefetch("key", func() (io.ReadCloser, error) {
+		return &endlessReader{closed: closed}, nil
+	})
+	time.Sleep(20 * time.Millisecond)
+	if !closed.Load() {
+		t.Error("Expected the source to be closed when nobody reads it")
+	}
+}
+
+func TestPrefetchFillsCache(t *testing.T) {
+	b := make([]byte, 16*1024)
+	_, _ = rand.Read(b)
+	callCount := 0
+	workFn := func() (io.ReadCloser, error) {
+		callCount++
+		return io.NopCloser(bytes.NewReader(b)), nil
+	}
+
+	g := &Group{Cache: &CachePolicy{TTL: time.Minute}}
+	g.Prefetch("key", workFn)
+	time.Sleep(20 * time.Millisecond)
+	g.Prefetch("key", workFn) // cached, so ignored
+	time.Sleep(10 * time.Millisecond)
+
+	res := g.DoResult(context.Background(), "key", func(context.Context) (io.ReadCloser, error) {
+		return workFn()
+	})
+	if !res.Cached {
+		t.Error("Expected a cached result")
+	}
+	if !bytes.Equal(readResult(t, res), b) {
+		t.Error("Cached bytes do not match source")
+	}
+	if callCount != 1 {
+		t.Errorf("Expected 1 call, got %d", callCount)
+	}
+}
+
+func TestPrefetchJoinedFlightAbandoned(t *testing.T) {
+	fillGate := make(chan struct{})
+	fillFn := func(ctx context.Context) (io.ReadCloser, error) {
+		<-fillGate
+		return io.NopCloser(bytes.NewReader([]byte("hello"))), nil
+	}
+	gate := make(chan struct{})
+	defer close(gate)
+	blockedFn := func(ctx context.Context) (io.ReadCloser, error) {
+		<-gate
+		return nil, ctx.Err()
+	}
+
+	// The first flight fills the cache, while the second (which later callers join) is still running
+	// once the stream goes stale
+	g := &Group{MaxWaitersPerFlight: 1, Cache: &CachePolicy{TTL: 20 * time.Millisecond, StaleWhileRevalidate: time.Minute}}
+	filled := make(chan Result, 1)
+	go func() {
+		filled <- g.DoResult(context.Background(), "key", fillFn)
+	}()
+	time.Sleep(10 * time.Millisecond)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_, _, _ = g.DoContext(ctx, "key", blockedFn)
+	}()
+	time.Sleep(10 * time.Millisecond)
+	close(fillGate)
+	readResult(t, <-filled)
+	time.Sleep(30 * time.Millisecond)
+
+	// The running flight would refresh the cache, until its caller gives up on it
+	refreshCount := new(atomic.Int32)
+	g.Prefetch("key", func() (io.ReadCloser, error) {
+		refreshCount.Add(1)
+		return io.NopCloser(bytes.NewReader([]byte("hello"))), nil
+	})
+	cancel()
+	<-done
+
+	res := g.DoResult(context.Background(), "key", func(ctx context.Context) (io.ReadCloser, error) {
+		refreshCount.Add(1)
+		return io.NopCloser(bytes.NewReader([]byte("hello"))), nil
+	})
+	if !res.Stale {
+		t.Errorf("Expected a stale cached result, got %+v", res)
+	}
+	readResult(t, res)
+	time.Sleep(10 * time.Millisecond)
+	if refreshCount.Load() != 1 {
+		t.Errorf("Expected the stale stream to be refreshed once, got %d calls", refreshCount.Load())
+	}
+}
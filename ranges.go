@@ -0,0 +1,255 @@
+package sfstreams
+
+import (
+	"errors"
+	"io"
+	"math"
+	"strconv"
+)
+
+// rangeFlight is a byte range of a key which is currently being fetched by a work function.
+type rangeFlight struct {
+	id     string
+	offset int64
+	length int64 // negative for "until the end of the source"
+}
+
+func (f *rangeFlight) end() int64 {
+	if f.length < 0 {
+		return math.MaxInt64
+	}
+	return f.offset + f.length
+}
+
+func (f *rangeFlight) contains(offset int64) bool {
+	return offset >= f.offset && offset < f.end()
+}
+
+// DoRange behaves like Do, but for a byte range of the resource identified by key. The work function
+// is given the offset and length of the range it should fetch, which is not necessarily the range the
+// caller asked for: when the requested range overlaps a range that is already being fetched for the
+// same key, the overlapping bytes are served from that flight and only the remaining bytes are fetched.
+// Disjoint ranges are fetched in parallel.
+//
+// A negative length requests all bytes from offset to the end of the resource. The reader returned by
+// fn must start at the given offset, and may end early if the resource is shorter than the range.
+//
+// The returned reader is unique to the caller, and the caller is responsible for closing it.
+func (g *KeyedGroup[K]) DoRange(key K, offset int64, length int64, fn func(offset int64, length int64) (io.ReadCloser, error), opts ...CallOption) (reader io.ReadCloser, err error, shared bool) {
+	if offset < 0 {
+		return nil, errors.New("sfstreams: negative range offset"), false
+	}
+	end := int64(math.MaxInt64)
+	if length >= 0 {
+		end = offset + length
+	}
+
+	r := &rangeReader[K]{
+		g:     g,
+		key:   key,
+		fn:    fn,
+		opts:  opts,
+		start: offset,
+		pos:   offset,
+		end:   end,
+	}
+	if offset >= end {
+		return r, nil, false
+	}
+	shared, err = r.next()
+	if err != nil && r.cur == nil {
+		return nil, err, shared
+	}
+	return r, err, shared
+}
+
+// planRange finds (or starts) the flight which will serve the bytes at offset for key, returning the
+// flight and how many of the requested bytes it can serve. The returned length is negative if the
+// flight serves all bytes to the end of the resource.
+func (g *KeyedGroup[K]) planRange(key K, offset int64, end int64) (*rangeFlight, int64) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if g.ranges == nil {
+		g.ranges = make(map[K][]*rangeFlight)
+	}
+	if g.rangeGroup == nil {
+		// Range flights are subject to the same configuration and limits as the group's other flights
+		g.init()
+		g.rangeGroup = &Group{
+			Retry:      g.Retry,
+			HedgeAfter: g.HedgeAfter,
+			workSem:    g.workSem,
+			copySem:    g.copySem,
+			budget:     g.budget,
+		}
+	}
+
+	for _, f := range g.ranges[key] {
+		if f.contains(offset) {
+			if fEnd := f.end(); fEnd < end {
+				end = fEnd
+			}
+			return f, rangeLength(offset, end)
+		}
+	}
+
+	// Nothing covers the offset, so start a new flight which stops where the next one begins
+	for _, f := range g.ranges[key] {
+		if f.offset > offset && f.offset < end {
+			end = f.offset
+		}
+	}
+	g.rangeSeq++
+	f := &rangeFlight{
+		id:     strconv.FormatUint(g.rangeSeq, 10),
+		offset: offset,
+		length: rangeLength(offset, end),
+	}
+	g.ranges[key] = append(g.ranges[key], f)
+	return f, f.length
+}
+
+func (g *KeyedGroup[K]) finishRange(key K, f *rangeFlight) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	flights := g.ranges[key]
+	for i, other := range flights {
+		if other == f {
+			flights = append(flights[:i], flights[i+1:]...)
+			break
+		}
+	}
+	if len(flights) == 0 {
+		delete(g.ranges, key)
+	} else {
+		g.ranges[key] = flights
+	}
+}
+
+func rangeLength(offset int64, end int64) int64 {
+	if end == math.MaxInt64 {
+		return -1
+	}
+	return end - offset
+}
+
+// rangeReader stitches together the flights serving a requested range. Each segment is planned
+// only once the previous one has been consumed, so a resource ending early does not trigger fetches
+// for bytes which don't exist.
+type rangeReader[K comparable] struct {
+	io.ReadCloser
+	g      *KeyedGroup[K]
+	key    K
+	fn     func(offset int64, length int64) (io.ReadCloser, error)
+	opts   []CallOption
+	start  int64
+	pos    int64
+	end    int64
+	cur    io.ReadCloser
+	curEnd int64
+	closed bool
+}
+
+func (r *rangeReader[K]) next() (bool, error) {
+	f, length := r.g.planRange(r.key, r.pos, r.end)
+	work := func() (io.ReadCloser, error) {
+		defer r.g.finishRange(r.key, f)
+		return r.fn(f.offset, f.length)
+	}
+
+	cur, err, shared := r.g.rangeGroup.Do(f.id, work, r.opts...)
+	err = r.rekey(err)
+	if cur == nil {
+		if err == nil {
+			// Nothing to stream, so treat it as the end of the resource
+			r.end = r.pos
+		}
+		return shared, err
+	}
+	if skip := r.pos - f.offset; skip > 0 {
+		if _, skipErr := io.CopyN(io.Discard, cur, skip); skipErr != nil {
+			_ = cur.Close()
+			if errors.Is(skipErr, io.EOF) {
+				// The resource ended before the range started
+				r.end = r.pos
+				return shared, err
+			}
+			return shared, r.rekey(skipErr)
+		}
+	}
+
+	r.cur = cur
+	r.curEnd = int64(math.MaxInt64)
+	if length >= 0 {
+		r.curEnd = r.pos + length
+	}
+	return shared, err
+}
+
+func (r *rangeReader[K]) Read(p []byte) (int, error) {
+	if r.closed {
+		return 0, ErrReaderClosed
+	}
+	for {
+		if r.cur == nil {
+			if r.pos >= r.end {
+				return 0, io.EOF
+			}
+			if _, err := r.next(); err != nil {
+				return 0, err
+			}
+			if r.cur == nil {
+				continue
+			}
+		}
+
+		if remaining := r.curEnd - r.pos; int64(len(p)) > remaining {
+			p = p[:remaining]
+		}
+		n, err := r.cur.Read(p)
+		r.pos += int64(n)
+
+		if errors.Is(err, io.EOF) || r.pos >= r.curEnd {
+			if r.pos < r.curEnd {
+				// The resource is shorter than the range
+				r.end = r.pos
+			}
+			// The flight may still be serving bytes beyond our segment to other readers, so
+			// detach from it rather than reading to its end.
+			_ = r.cur.Close()
+			r.cur = nil
+			if n > 0 {
+				return n, nil
+			}
+			continue
+		}
+		return n, r.rekey(err)
+	}
+}
+
+// rekey rewrites an error from one of the range's flights, which are keyed internally, to refer to
+// the caller's key and range instead.
+func (r *rangeReader[K]) rekey(err error) error {
+	var workErr *WorkError
+	if errors.As(err, &workErr) {
+		return &WorkError{Key: r.key, Err: workErr.Err}
+	}
+	var sourceErr *SourceError
+	if errors.As(err, &sourceErr) {
+		return &SourceError{Key: r.key, Err: sourceErr.Err, BytesDelivered: r.pos - r.start}
+	}
+	return err
+}
+
+// Close detaches the reader from the flight it is reading, and prevents it from starting any more.
+func (r *rangeReader[K]) Close() error {
+	r.closed = true
+	if r.cur == nil {
+		return nil
+	}
+	cur := r.cur
+	r.cur = nil
+	return cur.Close()
+}
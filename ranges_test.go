@@ -0,0 +1,178 @@
+package sfstreams
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"io"
+	"sync"
+	"testing"
+	"time"
+)
+
+type rangeCall struct {
+	offset int64
+	length int64
+}
+
+func makeRangeSource(size int) ([]byte, func(offset int64, length int64) (io.ReadCloser, error), func() []rangeCall, chan struct{}) {
+	b := make([]byte, size)
+	_, _ = rand.Read(b)
+
+	mu := new(sync.Mutex)
+	calls := make([]rangeCall, 0)
+	gate := make(chan struct{})
+	fn := func(offset int64, length int64) (io.ReadCloser, error) {
+		mu.Lock()
+		calls = append(calls, rangeCall{offset: offset, length: length})
+		mu.Unlock()
+		<-gate
+		end := int64(len(b))
+		if length >= 0 && offset+length < end {
+			end = offset + length
+		}
+		if offset > end {
+			offset = end
+		}
+		return io.NopCloser(bytes.NewReader(b[offset:end])), nil
+	}
+	getCalls := func() []rangeCall {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]rangeCall(nil), calls...)
+	}
+	return b, fn, getCalls, gate
+}
+
+func readRange(t *testing.T, g *Group, key string, offset int64, length int64, fn func(offset int64, length int64) (io.ReadCloser, error)) []byte {
+	r, err, _ := g.DoRange(key, offset, length, fn)
+	if err != nil {
+		t.Error(err)
+		return nil
+	}
+	//goland:noinspection GoUnhandledErrorResult
+	defer r.Close()
+	b, err := io.ReadAll(r)
+	if err != nil {
+		t.Error(err)
+	}
+	return b
+}
+
+func TestDoRange(t *testing.T) {
+	b, fn, getCalls, gate := makeRangeSource(4096)
+	close(gate)
+
+	g := new(Group)
+	res := readRange(t, g, "key", 100, 200, fn)
+	if !bytes.Equal(res, b[100:300]) {
+		t.Error("Range bytes do not match source")
+	}
+
+	calls := getCalls()
+	if len(calls) != 1 || calls[0] != (rangeCall{offset: 100, length: 200}) {
+		t.Errorf("Unexpected work function calls: %v", calls)
+	}
+}
+
+func TestDoRangeToEnd(t *testing.T) {
+	b, fn, _, gate := makeRangeSource(4096)
+	close(gate)
+
+	g := new(Group)
+	res := readRange(t, g, "key", 4000, -1, fn)
+	if !bytes.Equal(res, b[4000:]) {
+		t.Error("Range bytes do not match source")
+	}
+
+	res = readRange(t, g, "key", 4000, 500, fn)
+	if !bytes.Equal(res, b[4000:]) {
+		t.Error("Short range bytes do not match source")
+	}
+}
+
+func TestDoRangeCoalesces(t *testing.T) {
+	b, fn, getCalls, gate := makeRangeSource(4096)
+
+	g := new(Group)
+	wg := new(sync.WaitGroup)
+	results := make([][]byte, 3)
+	ranges := []rangeCall{{0, 1024}, {100, 200}, {1000, 500}}
+	for i, rc := range ranges {
+		wg.Add(1)
+		go func(i int, rc rangeCall) {
+			defer wg.Done()
+			results[i] = readRange(t, g, "key", rc.offset, rc.length, fn)
+		}(i, rc)
+		time.Sleep(10 * time.Millisecond) // ensure the flights are started in order
+	}
+	close(gate)
+	wg.Wait()
+
+	for i, rc := range ranges {
+		if !bytes.Equal(results[i], b[rc.offset:rc.offset+rc.length]) {
+			t.Errorf("Range %d bytes do not match source", i)
+		}
+	}
+
+	// The second range is fully covered by the first, and the third only needs the bytes after it
+	calls := getCalls()
+	if len(calls) != 2 {
+		t.Fatalf("Expected 2 calls, got %v", calls)
+	}
+	if calls[0] != (rangeCall{offset: 0, length: 1024}) || calls[1] != (rangeCall{offset: 1024, length: 476}) {
+		t.Errorf("Unexpected work function calls: %v", calls)
+	}
+}
+
+func TestDoRangeDisjoint(t *testing.T) {
+	b, fn, getCalls, gate := makeRangeSource(4096)
+
+	g := new(Group)
+	wg := new(sync.WaitGroup)
+	results := make([][]byte, 2)
+	ranges := []rangeCall{{0, 100}, {2000, 100}}
+	for i, rc := range ranges {
+		wg.Add(1)
+		go func(i int, rc rangeCall) {
+			defer wg.Done()
+			results[i] = readRange(t, g, "key", rc.offset, rc.length, fn)
+		}(i, rc)
+	}
+
+	// Both flights should be running at the same time
+	for len(getCalls()) < 2 {
+		time.Sleep(time.Millisecond)
+	}
+	close(gate)
+	wg.Wait()
+
+	for i, rc := range ranges {
+		if !bytes.Equal(results[i], b[rc.offset:rc.offset+rc.length]) {
+			t.Errorf("Range %d bytes do not match source", i)
+		}
+	}
+}
+
+func TestDoRangeClosed(t *testing.T) {
+	_, fn, getCalls, gate := makeRangeSource(4096)
+	close(gate)
+
+	g := new(Group)
+	r, err, _ := g.DoRange("key", 0, 1024, fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = r.Close()
+
+	// A closed reader neither reads nor starts new flights for the rest of the range
+	for i := 0; i < 2; i++ {
+		n, err := r.Read(make([]byte, 10))
+		if n != 0 || !errors.Is(err, ErrReaderClosed) {
+			t.Errorf("Expected ErrReaderClosed, got n=%d err=%v", n, err)
+		}
+	}
+	if calls := getCalls(); len(calls) != 1 {
+		t.Errorf("Expected 1 call, got %v", calls)
+	}
+}
@@ -0,0 +1,90 @@
+package sfstreams
+
+import (
+	"sync"
+	"time"
+)
+
+// refCount tracks the users of a shared resource, such as a source, and releases the resource once
+// the last user has gone away. When linger is greater than zero, the release is delayed by that long,
+// and a user arriving in the meantime keeps the resource alive.
+type refCount struct {
+	mu       sync.Mutex
+	cond     *sync.Cond
+	n        int
+	linger   time.Duration
+	timer    *time.Timer
+	released bool
+	release  func()
+}
+
+// newRefCount creates a refCount with n users, which calls release once they have all gone away.
+func newRefCount(n int, linger time.Duration, release func()) *refCount {
+	c := &refCount{
+		n:       n,
+		linger:  linger,
+		release: release,
+	}
+	c.cond = sync.NewCond(&c.mu)
+	return c
+}
+
+// acquire adds a user, returning false if the resource has already been released.
+func (c *refCount) acquire() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.released {
+		return false
+	}
+	c.n++
+	if c.timer != nil {
+		c.timer.Stop()
+		c.timer = nil
+	}
+	c.cond.Broadcast()
+	return true
+}
+
+// done removes a user, releasing the resource if it was the last one.
+func (c *refCount) done() {
+	c.mu.Lock()
+	c.n--
+	if c.n > 0 || c.released {
+		c.mu.Unlock()
+		return
+	}
+	if c.linger <= 0 {
+		c.released = true
+		c.cond.Broadcast()
+		c.mu.Unlock()
+		c.release()
+		return
+	}
+
+	var t *time.Timer
+	t = time.AfterFunc(c.linger, func() {
+		c.mu.Lock()
+		if c.timer != t {
+			// A user arrived (and possibly left again) before the timer fired
+			c.mu.Unlock()
+			return
+		}
+		c.timer = nil
+		c.released = true
+		c.cond.Broadcast()
+		c.mu.Unlock()
+		c.release()
+	})
+	c.timer = t
+	c.mu.Unlock()
+}
+
+// wait blocks until there is at least one user, returning false if the resource was released instead.
+func (c *refCount) wait() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for c.n == 0 && !c.released {
+		c.cond.Wait()
+	}
+	return !c.released
+}
@@ -0,0 +1,117 @@
+package sfstreams
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+)
+
+// Result carries the outcome of a call to KeyedGroup.DoResult.
+type Result struct {
+	// Reader is the caller's own reader of the stream, which the caller is responsible for closing.
+	// It is nil if there is no stream.
+	Reader io.ReadCloser
+
+	// Err is the error returned by the work function (see WorkError), or the caller's context error
+	// if it stopped waiting.
+	Err error
+
+	// Shared is true when the flight was shared with other callers, as with Do.
+	Shared bool
+
+	// Cached is true when the stream was served from the cache (see KeyedGroup.Cache), rather than
+	// from a flight.
+	Cached bool
+
+	// Stale is true when the cached stream is past its TTL, and is being refreshed in the background
+	// (see CachePolicy.StaleWhileRevalidate).
+	Stale bool
+
+	// Leader is true when the caller started the flight, and so its work function was the one called.
+	Leader bool
+
+	// Waiters is how many callers received the flight's result, including this one. For callers
+	// joining a live broadcast (see KeyedGroup.Broadcast), it is how many readers were attached.
+	Waiters int
+
+	// WorkDuration is how long the work function took to return, including any retries, hedged calls,
+	// and time spent queued for MaxConcurrentWork.
+	WorkDuration time.Duration
+
+	// Meta is the metadata the work function attached to its stream using SetMeta, if any. It is
+	// shared by every caller of the flight, and so should not be modified.
+	Meta any
+}
+
+// DoResult behaves like DoContext, but returns a Result describing the call and its flight. This is
+// useful for logging and attributing the cost of each flight to its callers.
+func (g *KeyedGroup[K]) DoResult(ctx context.Context, key K, fn func(ctx context.Context) (io.ReadCloser, error), opts ...CallOption) Result {
+	return g.do(ctx, key, fn, nil, opts)
+}
+
+// result builds the Result for a caller of the flight.
+func (f *flight) result(r io.ReadCloser, err error, shared bool, leader bool) Result {
+	return Result{
+		Reader:       r,
+		Err:          err,
+		Shared:       shared,
+		Leader:       leader,
+		Waiters:      f.delivered,
+		WorkDuration: f.workDuration,
+		Meta:         f.meta.get(),
+	}
+}
+
+type metaKey struct{}
+
+// metaBox holds the metadata attached by a work function.
+type metaBox struct {
+	mu   sync.Mutex
+	meta any
+}
+
+func (b *metaBox) get() any {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.meta
+}
+
+func (b *metaBox) set(meta any) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.meta = meta
+}
+
+// SetMeta attaches metadata, such as a content type or ETag, to the stream a work function returns.
+// ctx must be (or derive from) the context given to the work function by DoContext, DoResult, or
+// similar. The metadata is made available to every caller of the flight through Result.Meta. Calling
+// SetMeta again replaces the metadata. It does nothing if ctx didn't come from a Group.
+func SetMeta(ctx context.Context, meta any) {
+	if b, ok := ctx.Value(metaKey{}).(*metaBox); ok {
+		b.set(meta)
+	}
+}
+
+// DoWithMeta behaves like KeyedGroup.Do, but for work functions which produce metadata alongside their
+// stream, such as a content type, ETag, or headers. Every caller receives its own reader and the
+// metadata returned by the work function which ran, which is shared between them and so should not be
+// modified. The metadata is returned even when the work function also returns an error.
+//
+// If the caller joins a flight started by a call other than DoWithMeta (or by DoWithMeta with another
+// metadata type), meta is the zero value of M. For a ShardedGroup, use DoWithMeta(s.Shard(key), ...).
+func DoWithMeta[K comparable, M any](g *KeyedGroup[K], key K, fn func() (io.ReadCloser, M, error), opts ...CallOption) (reader io.ReadCloser, meta M, err error, shared bool) {
+	res := g.DoResult(context.Background(), key, func(ctx context.Context) (io.ReadCloser, error) {
+		r, m, err := fn()
+		SetMeta(ctx, m)
+		return r, err
+	}, opts...)
+	if raw, ok := res.Meta.(json.RawMessage); ok {
+		// The metadata was loaded from the cache's index on disk (see CachePolicy.Dir)
+		_ = json.Unmarshal(raw, &meta)
+	} else {
+		meta, _ = res.Meta.(M)
+	}
+	return res.Reader, meta, res.Err, res.Shared
+}
@@ -0,0 +1,191 @@
+package sfstreams
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"io"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestDoResult(t *testing.T) {
+	key, expectedBytes, src := makeStream()
+
+	gate := make(chan struct{})
+	workFn := func(ctx context.Context) (io.ReadCloser, error) {
+		<-gate
+		SetMeta(ctx, "text/plain")
+		return src, nil
+	}
+
+	g := new(Group)
+	wg := new(sync.WaitGroup)
+	results := make([]Result, 3)
+	for i := range results {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			res := g.DoResult(context.Background(), key, workFn)
+			if res.Err != nil {
+				t.Error(res.Err)
+				return
+			}
+			//goland:noinspection GoUnhandledErrorResult
+			defer res.Reader.Close()
+			c, _ := io.Copy(io.Discard, res.Reader)
+			if c != expectedBytes {
+				t.Errorf("Read %d bytes but expected %d", c, expectedBytes)
+			}
+			results[i] = res
+		}(i)
+		time.Sleep(10 * time.Millisecond) // ensure the first call starts the flight
+	}
+	time.Sleep(20 * time.Millisecond)
+	close(gate)
+	wg.Wait()
+
+	for i, res := range results {
+		if res.Leader != (i == 0) {
+			t.Errorf("Expected only the first caller to be the leader, got %v for caller %d", res.Leader, i)
+		}
+		if !res.Shared {
+			t.Errorf("Expected caller %d to be shared", i)
+		}
+		if res.Waiters != 3 {
+			t.Errorf("Expected 3 waiters, got %d", res.Waiters)
+		}
+		if res.WorkDuration < 20*time.Millisecond {
+			t.Errorf("Expected the work duration to include the wait, got %s", res.WorkDuration)
+		}
+		if res.Meta != "text/plain" {
+			t.Errorf("Expected metadata to be shared, got %v", res.Meta)
+		}
+	}
+}
+
+func TestDoResultHedgeMeta(t *testing.T) {
+	b := make([]byte, 1024)
+	_, _ = rand.Read(b)
+
+	mu := new(sync.Mutex)
+	callCount := 0
+	workFn := func(ctx context.Context) (io.ReadCloser, error) {
+		mu.Lock()
+		callCount++
+		call := callCount
+		mu.Unlock()
+		SetMeta(ctx, call)
+		if call == 1 {
+			<-ctx.Done() // stall until the hedged call wins
+			return nil, ctx.Err()
+		}
+		return io.NopCloser(bytes.NewReader(b)), nil
+	}
+
+	g := &Group{HedgeAfter: 10 * time.Millisecond}
+	res := g.DoResult(context.Background(), "key", workFn)
+	if res.Err != nil {
+		t.Fatal(res.Err)
+	}
+	//goland:noinspection GoUnhandledErrorResult
+	defer res.Reader.Close()
+	if res.Meta != 2 {
+		t.Errorf("Expected the hedged call's metadata, got %v", res.Meta)
+	}
+}
+
+func TestSetMetaOutsideGroup(t *testing.T) {
+	SetMeta(context.Background(), "ignored") // should not panic
+}
+
+type testMeta struct {
+	ContentType string
+	ETag        string
+}
+
+func TestDoWithMeta(t *testing.T) {
+	key, expectedBytes, src := makeStream()
+
+	mu := new(sync.Mutex)
+	callCount := 0
+	gate := make(chan struct{})
+	workFn := func() (io.ReadCloser, testMeta, error) {
+		mu.Lock()
+		callCount++
+		mu.Unlock()
+		<-gate
+		return src, testMeta{ContentType: "text/plain", ETag: "abc"}, nil
+	}
+
+	g := new(Group)
+	wg := new(sync.WaitGroup)
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			r, meta, err, _ := DoWithMeta(g, key, workFn)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			//goland:noinspection GoUnhandledErrorResult
+			defer r.Close()
+			if meta.ContentType != "text/plain" || meta.ETag != "abc" {
+				t.Errorf("Unexpected metadata: %+v", meta)
+			}
+			c, _ := io.Copy(io.Discard, r)
+			if c != expectedBytes {
+				t.Errorf("Read %d bytes but expected %d", c, expectedBytes)
+			}
+		}()
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(gate)
+	wg.Wait()
+
+	if callCount != 1 {
+		t.Errorf("Expected 1 call, got %d", callCount)
+	}
+}
+
+func TestDoWithMetaJoinsPlainFlight(t *testing.T) {
+	key, _, src := makeStream()
+
+	gate := make(chan struct{})
+	g := new(Group)
+	ch := g.DoChan(key, func() (io.ReadCloser, error) {
+		<-gate
+		return src, nil
+	})
+	time.Sleep(20 * time.Millisecond)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		r, meta, err, shared := DoWithMeta(g, key, func() (io.ReadCloser, testMeta, error) {
+			t.Error("Expected the existing flight to be joined")
+			return nil, testMeta{}, nil
+		})
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		_ = r.Close()
+		if !shared {
+			t.Error("Expected a shared result")
+		}
+		if meta != (testMeta{}) {
+			t.Errorf("Expected no metadata, got %+v", meta)
+		}
+	}()
+	time.Sleep(20 * time.Millisecond)
+	close(gate)
+	res := <-ch
+	if res.Err != nil {
+		t.Fatal(res.Err)
+	}
+	_ = res.Reader.Close()
+	<-done
+}
@@ -0,0 +1,60 @@
+package sfstreams
+
+import (
+	"context"
+	"io"
+)
+
+// defaultResumePolicy limits resumes when no RetryPolicy applies to a resumable flight.
+var defaultResumePolicy = &RetryPolicy{MaxAttempts: 3}
+
+// DoResumable behaves like Do, but the work function is given the offset at which its stream should
+// start. The work function is first called with an offset of zero. If the stream it returns fails
+// partway through, the work function is called again with the number of bytes delivered so far and
+// copying continues from the new stream, so readers see one uninterrupted stream. A stream which ends
+// with io.EOF is considered complete.
+//
+// Resumes follow the Retry policy (or WithRetry option): each failure counts as an attempt, and the
+// count is reset whenever the source delivers more bytes. When no policy applies, up to 3 consecutive
+// attempts are made.
+//
+// Resuming only applies to the copy behaviour. When UseSeekers is set and fn returns an
+// io.ReadSeekCloser, the stream is shared as-is and not resumed.
+func (g *KeyedGroup[K]) DoResumable(key K, fn func(offset int64) (io.ReadCloser, error), opts ...CallOption) (reader io.ReadCloser, err error, shared bool) {
+	res := g.do(context.Background(), key, func(context.Context) (io.ReadCloser, error) {
+		return fn(0)
+	}, func(_ context.Context, offset int64) (io.ReadCloser, error) {
+		return fn(offset)
+	}, opts)
+	return res.Reader, res.Err, res.Shared
+}
+
+// resumeSource reopens a failed source at offset, following the retry policy. It returns the new
+// source and the updated attempt count, or the error to give to readers if the source couldn't be
+// resumed.
+func resumeSource(ctx context.Context, resume func(ctx context.Context, offset int64) (io.ReadCloser, error), offset int64, attempt int, err error, policy *RetryPolicy) (io.ReadCloser, int, error) {
+	if policy == nil {
+		policy = defaultResumePolicy
+	}
+	for {
+		attempt++
+		if !policy.retryable(attempt, err) {
+			return nil, attempt, err
+		}
+		if waitErr := policy.wait(ctx, attempt); waitErr != nil {
+			return nil, attempt, waitErr
+		}
+
+		r, openErr := resume(ctx, offset)
+		if openErr == nil && r != nil {
+			return r, attempt, nil
+		}
+		if r != nil {
+			_ = r.Close()
+		}
+		if openErr == nil {
+			openErr = io.ErrUnexpectedEOF
+		}
+		err = openErr
+	}
+}
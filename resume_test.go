@@ -0,0 +1,119 @@
+package sfstreams
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"io"
+	"sync"
+	"testing"
+	"time"
+)
+
+// flakyReader fails with an error after reading limit bytes.
+type flakyReader struct {
+	r     io.Reader
+	limit int64
+	err   error
+}
+
+func (f *flakyReader) Read(p []byte) (int, error) {
+	if f.limit <= 0 {
+		return 0, f.err
+	}
+	if int64(len(p)) > f.limit {
+		p = p[:f.limit]
+	}
+	n, err := f.r.Read(p)
+	f.limit -= int64(n)
+	return n, err
+}
+
+func TestDoResumable(t *testing.T) {
+	b := make([]byte, 16*1024)
+	_, _ = rand.Read(b)
+	dropErr := errors.New("connection dropped")
+
+	mu := new(sync.Mutex)
+	offsets := make([]int64, 0)
+	gate := make(chan struct{})
+	workFn := func(offset int64) (io.ReadCloser, error) {
+		mu.Lock()
+		offsets = append(offsets, offset)
+		mu.Unlock()
+		<-gate
+		return io.NopCloser(&flakyReader{r: bytes.NewReader(b[offset:]), limit: 5000, err: dropErr}), nil
+	}
+
+	g := new(Group)
+	wg := new(sync.WaitGroup)
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			r, err, _ := g.DoResumable("key", workFn)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			//goland:noinspection GoUnhandledErrorResult
+			defer r.Close()
+			res, err := io.ReadAll(r)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if !bytes.Equal(res, b) {
+				t.Error("Read bytes do not match source")
+			}
+		}()
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(gate)
+	wg.Wait()
+
+	expected := []int64{0, 5000, 10000, 15000}
+	if len(offsets) != len(expected) {
+		t.Fatalf("Expected offsets %v, got %v", expected, offsets)
+	}
+	for i, o := range expected {
+		if offsets[i] != o {
+			t.Fatalf("Expected offsets %v, got %v", expected, offsets)
+		}
+	}
+}
+
+func TestDoResumableGivesUp(t *testing.T) {
+	b := make([]byte, 16*1024)
+	_, _ = rand.Read(b)
+	dropErr := errors.New("connection dropped")
+
+	callCount := 0
+	workFn := func(offset int64) (io.ReadCloser, error) {
+		callCount++
+		limit := int64(5000)
+		if offset > 0 {
+			limit = 0 // never make progress after the first failure
+		}
+		return io.NopCloser(&flakyReader{r: bytes.NewReader(b[offset:]), limit: limit, err: dropErr}), nil
+	}
+
+	g := new(Group)
+	g.Retry = &RetryPolicy{MaxAttempts: 2}
+	r, err, _ := g.DoResumable("key", workFn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	//goland:noinspection GoUnhandledErrorResult
+	defer r.Close()
+	res, err := io.ReadAll(r)
+	if !errors.Is(err, dropErr) {
+		t.Errorf("Expected %v, got %v", dropErr, err)
+	}
+	if len(res) != 5000 {
+		t.Errorf("Expected to read 5000 bytes, got %d", len(res))
+	}
+	if callCount != 2 {
+		t.Errorf("Expected 2 calls, got %d", callCount)
+	}
+}
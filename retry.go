@@ -0,0 +1,76 @@
+package sfstreams
+
+import (
+	"context"
+	"io"
+	"time"
+)
+
+// RetryPolicy describes how a failed work function is retried before its error is returned to the
+// callers waiting on it. Retries happen once on behalf of all callers sharing the flight.
+type RetryPolicy struct {
+	// MaxAttempts is the maximum number of times the work function is called, including the first
+	// call. Values less than 2 disable retries.
+	MaxAttempts int
+
+	// Backoff returns how long to wait before the given retry, where the first retry is attempt 1.
+	// When nil, retries happen immediately.
+	Backoff func(attempt int) time.Duration
+
+	// Retryable reports whether the work function should be called again after returning err. When
+	// nil, all errors are retried.
+	Retryable func(err error) bool
+}
+
+// ExponentialBackoff returns a RetryPolicy.Backoff function which doubles the delay on each retry,
+// starting at initial and capped at max.
+func ExponentialBackoff(initial time.Duration, max time.Duration) func(attempt int) time.Duration {
+	return func(attempt int) time.Duration {
+		d := initial
+		for i := 1; i < attempt && d < max; i++ {
+			d *= 2
+		}
+		if d > max {
+			d = max
+		}
+		return d
+	}
+}
+
+func (p *RetryPolicy) retryable(attempt int, err error) bool {
+	if p == nil || err == nil || attempt >= p.MaxAttempts {
+		return false
+	}
+	return p.Retryable == nil || p.Retryable(err)
+}
+
+// wait sleeps for the backoff of the given retry attempt, stopping early if ctx is done.
+func (p *RetryPolicy) wait(ctx context.Context, attempt int) error {
+	if p.Backoff == nil {
+		return ctx.Err()
+	}
+	t := time.NewTimer(p.Backoff(attempt))
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// call runs fn until it succeeds, the policy gives up, or ctx is done. A nil policy calls fn once.
+func (p *RetryPolicy) call(ctx context.Context, fn func(ctx context.Context) (io.ReadCloser, error)) (io.ReadCloser, error) {
+	for attempt := 1; ; attempt++ {
+		r, err := fn(ctx)
+		if !p.retryable(attempt, err) {
+			return r, err
+		}
+		if r != nil {
+			_ = r.Close()
+		}
+		if waitErr := p.wait(ctx, attempt); waitErr != nil {
+			return nil, waitErr
+		}
+	}
+}
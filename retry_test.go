@@ -0,0 +1,130 @@
+package sfstreams
+
+import (
+	"errors"
+	"io"
+	"testing"
+	"time"
+)
+
+func TestRetrySucceeds(t *testing.T) {
+	key, expectedBytes, src := makeStream()
+	transientErr := errors.New("transient")
+
+	callCount := 0
+	workFn := func() (io.ReadCloser, error) {
+		callCount++
+		if callCount < 3 {
+			return nil, transientErr
+		}
+		return src, nil
+	}
+
+	g := new(Group)
+	g.Retry = &RetryPolicy{MaxAttempts: 3}
+	r, err, _ := g.Do(key, workFn)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//goland:noinspection GoUnhandledErrorResult
+	defer r.Close()
+	c, _ := io.Copy(io.Discard, r)
+	if c != expectedBytes {
+		t.Errorf("Read %d bytes but expected %d", c, expectedBytes)
+	}
+	if callCount != 3 {
+		t.Errorf("Expected 3 calls, got %d", callCount)
+	}
+}
+
+func TestRetryGivesUp(t *testing.T) {
+	expectedErr := errors.New("this is expected")
+	callCount := 0
+	workFn := func() (io.ReadCloser, error) {
+		callCount++
+		return nil, expectedErr
+	}
+
+	backoffs := make([]int, 0)
+	g := new(Group)
+	g.Retry = &RetryPolicy{
+		MaxAttempts: 3,
+		Backoff: func(attempt int) time.Duration {
+			backoffs = append(backoffs, attempt)
+			return time.Millisecond
+		},
+	}
+	r, err, _ := g.Do("key", workFn)
+	if !errors.Is(err, expectedErr) {
+		t.Errorf("Expected %v, got %v", expectedErr, err)
+	}
+	if r != nil {
+		t.Error("Expected no reader")
+	}
+	if callCount != 3 {
+		t.Errorf("Expected 3 calls, got %d", callCount)
+	}
+	if len(backoffs) != 2 || backoffs[0] != 1 || backoffs[1] != 2 {
+		t.Errorf("Unexpected backoff attempts: %v", backoffs)
+	}
+}
+
+func TestRetryNotRetryable(t *testing.T) {
+	permanentErr := errors.New("permanent")
+	callCount := 0
+	workFn := func() (io.ReadCloser, error) {
+		callCount++
+		return nil, permanentErr
+	}
+
+	g := new(Group)
+	g.Retry = &RetryPolicy{
+		MaxAttempts: 5,
+		Retryable: func(err error) bool {
+			return !errors.Is(err, permanentErr)
+		},
+	}
+	_, err, _ := g.Do("key", workFn)
+	if !errors.Is(err, permanentErr) {
+		t.Errorf("Expected %v, got %v", permanentErr, err)
+	}
+	if callCount != 1 {
+		t.Errorf("Expected 1 call, got %d", callCount)
+	}
+}
+
+func TestRetryCallOverride(t *testing.T) {
+	expectedErr := errors.New("this is expected")
+	callCount := 0
+	workFn := func() (io.ReadCloser, error) {
+		callCount++
+		return nil, expectedErr
+	}
+
+	g := new(Group)
+	g.Retry = &RetryPolicy{MaxAttempts: 5}
+	_, err, _ := g.Do("key", workFn, WithRetry(nil))
+	if !errors.Is(err, expectedErr) {
+		t.Errorf("Expected %v, got %v", expectedErr, err)
+	}
+	if callCount != 1 {
+		t.Errorf("Expected 1 call, got %d", callCount)
+	}
+
+	callCount = 0
+	_, _, _ = g.Do("key", workFn, WithRetry(&RetryPolicy{MaxAttempts: 2}))
+	if callCount != 2 {
+		t.Errorf("Expected 2 calls, got %d", callCount)
+	}
+}
+
+func TestExponentialBackoff(t *testing.T) {
+	backoff := ExponentialBackoff(10*time.Millisecond, 50*time.Millisecond)
+	expected := []time.Duration{10 * time.Millisecond, 20 * time.Millisecond, 40 * time.Millisecond, 50 * time.Millisecond, 50 * time.Millisecond}
+	for i, d := range expected {
+		if actual := backoff(i + 1); actual != d {
+			t.Errorf("Expected attempt %d to wait %s, got %s", i+1, d, actual)
+		}
+	}
+}
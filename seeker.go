@@ -3,30 +3,51 @@ package sfstreams
 import (
 	"errors"
 	"io"
+	"os"
 	"sync"
+	"time"
 )
 
 type parentSeeker struct {
 	io.ReadSeekCloser
+	key        any
 	underlying io.ReadSeekCloser
 	mutex      *sync.Mutex
-	closeWg    *sync.WaitGroup
+	refs       *refCount
 }
 
-func newParentSeeker(src io.ReadSeekCloser, downstreamReaders int) *parentSeeker {
-	wg := new(sync.WaitGroup)
-	wg.Add(downstreamReaders)
-	go func() {
-		wg.Wait()
-		_ = src.Close()
-	}()
+// newParentSeeker creates a parentSeeker which closes src once all downstream readers have closed (and
+// linger has passed without another reader attaching), calling onClose (if not nil) afterwards.
+func newParentSeeker(key any, src io.ReadSeekCloser, downstreamReaders int, linger time.Duration, onClose func()) *parentSeeker {
 	return &parentSeeker{
+		key:        key,
 		underlying: src,
 		mutex:      new(sync.Mutex),
-		closeWg:    wg,
+		refs: newRefCount(downstreamReaders, linger, func() {
+			_ = src.Close()
+			if onClose != nil {
+				onClose()
+			}
+		}),
 	}
 }
 
+// attach creates another downstream reader, returning nil if src has already been closed.
+func (p *parentSeeker) attach() *downstreamSeeker {
+	if !p.refs.acquire() {
+		return nil
+	}
+	return newSyncSeeker(p)
+}
+
+// sourceError wraps an error returned by the underlying source in a SourceError, leaving io.EOF as-is.
+func (p *parentSeeker) sourceError(err error, delivered int64) error {
+	if err == nil || errors.Is(err, io.EOF) {
+		return err
+	}
+	return &SourceError{Key: p.key, Err: err, BytesDelivered: delivered}
+}
+
 func (p *parentSeeker) Read(b []byte) (int, error) {
 	return p.underlying.Read(b)
 }
@@ -60,7 +81,7 @@ func newSyncSeeker(parent *parentSeeker) *downstreamSeeker {
 
 func (s *downstreamSeeker) Read(b []byte) (int, error) {
 	if s.closed {
-		return 0, io.ErrClosedPipe
+		return 0, ErrReaderClosed
 	}
 	s.parent.mutex.Lock()
 	defer s.parent.mutex.Unlock()
@@ -69,7 +90,7 @@ func (s *downstreamSeeker) Read(b []byte) (int, error) {
 	}
 	offset, err := s.parent.Seek(s.pos, io.SeekStart)
 	if err != nil {
-		return 0, err
+		return 0, s.parent.sourceError(err, s.pos)
 	}
 	i, err := s.parent.Read(b)
 	s.pos = offset + int64(i)
@@ -77,25 +98,95 @@ func (s *downstreamSeeker) Read(b []byte) (int, error) {
 		s.eof = true
 		s.eofPos = s.pos
 	}
-	return i, err
+	return i, s.parent.sourceError(err, s.pos)
+}
+
+// writeToChunkSize is the maximum number of bytes downstreamSeeker.WriteTo copies while holding the
+// parent's lock, giving other readers a chance to read/seek during large transfers.
+const writeToChunkSize = 1024 * 1024
+
+// WriteTo copies the remaining data directly from the parent's underlying reader, allowing io.Writer
+// implementations which support io.ReaderFrom to use sendfile or similar when the source is an *os.File.
+func (s *downstreamSeeker) WriteTo(w io.Writer) (int64, error) {
+	if s.closed {
+		return 0, ErrReaderClosed
+	}
+	total := int64(0)
+	for {
+		n, err := s.writeChunkTo(w)
+		total += n
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return total, nil
+			}
+			return total, err
+		}
+	}
+}
+
+func (s *downstreamSeeker) writeChunkTo(w io.Writer) (int64, error) {
+	s.parent.mutex.Lock()
+	defer s.parent.mutex.Unlock()
+	if s.eof && s.pos == s.eofPos {
+		return 0, io.EOF
+	}
+	offset, err := s.parent.Seek(s.pos, io.SeekStart)
+	if err != nil {
+		return 0, s.parent.sourceError(err, s.pos)
+	}
+	// Dev note: io.CopyN wraps the underlying reader in an io.LimitedReader, which is what the
+	// runtime looks for when deciding whether to use sendfile, so *os.File sources are passed as-is.
+	// Other sources are wrapped to tell their errors apart from w's, so they can be reported as a
+	// SourceError like Read does.
+	var src io.Reader = s.parent.underlying
+	var rec *readErrRecorder
+	if _, ok := src.(*os.File); !ok {
+		rec = &readErrRecorder{r: src}
+		src = rec
+	}
+	n, err := io.CopyN(w, src, writeToChunkSize)
+	s.pos = offset + n
+	if err != nil && errors.Is(err, io.EOF) {
+		s.eof = true
+		s.eofPos = s.pos
+	}
+	if rec != nil && rec.err != nil && err == rec.err {
+		return n, s.parent.sourceError(err, s.pos)
+	}
+	return n, err
+}
+
+// readErrRecorder remembers the last error returned by r.
+type readErrRecorder struct {
+	r   io.Reader
+	err error
+}
+
+func (r *readErrRecorder) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.err = err
+	return n, err
 }
 
 func (s *downstreamSeeker) Seek(offset int64, whence int) (int64, error) {
 	if s.closed {
-		return 0, io.ErrClosedPipe
+		return 0, ErrReaderClosed
 	}
 	s.parent.mutex.Lock()
 	defer s.parent.mutex.Unlock()
 	offset, err := s.parent.Seek(offset, whence)
 	if err != nil {
-		return s.pos, err
+		return s.pos, s.parent.sourceError(err, s.pos)
 	}
 	s.pos = offset
 	return s.pos, nil
 }
 
 func (s *downstreamSeeker) Close() error {
-	s.parent.closeWg.Done()
+	if s.closed {
+		return nil
+	}
 	s.closed = true
+	s.parent.refs.done()
 	return nil
 }
@@ -5,6 +5,7 @@ import (
 	"crypto/rand"
 	"errors"
 	"io"
+	"os"
 	"testing"
 )
 
@@ -31,7 +32,7 @@ func createSource(length int64, t *testing.T) (io.ReadSeekCloser, []byte) {
 
 func TestDuplicateReads(t *testing.T) {
 	rsc, b := createSource(1024, t)
-	ps := newParentSeeker(rsc, 2)
+	ps := newParentSeeker("key", rsc, 2, 0, nil)
 	s1 := newSyncSeeker(ps)
 	s2 := newSyncSeeker(ps)
 
@@ -72,7 +73,7 @@ func TestDuplicateReads(t *testing.T) {
 
 func TestOverRead(t *testing.T) {
 	rsc, _ := createSource(1024, t)
-	ps := newParentSeeker(rsc, 1)
+	ps := newParentSeeker("key", rsc, 1, 0, nil)
 	s1 := newSyncSeeker(ps)
 
 	// Discard the whole stream
@@ -122,7 +123,7 @@ func (b *badStream) Close() error {
 func TestImproperSourceOverRead(t *testing.T) {
 	_, b := createSource(1024, t)
 	bs := &badStream{source: bytes.NewReader(b)}
-	ps := newParentSeeker(bs, 1)
+	ps := newParentSeeker("key", bs, 1, 0, nil)
 	s1 := newSyncSeeker(ps)
 
 	// Discard the whole stream
@@ -144,7 +145,7 @@ func TestImproperSourceOverRead(t *testing.T) {
 
 func TestUseAfterClose(t *testing.T) {
 	rsc, _ := createSource(1024, t)
-	ps := newParentSeeker(rsc, 1)
+	ps := newParentSeeker("key", rsc, 1, 0, nil)
 	s1 := newSyncSeeker(ps)
 
 	// Close the whole thing
@@ -164,3 +165,44 @@ func TestUseAfterClose(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+func TestWriteToFile(t *testing.T) {
+	_, b := createSource(3*writeToChunkSize+12, t)
+	src, err := os.CreateTemp(t.TempDir(), "src")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = src.Write(b); err != nil {
+		t.Fatal(err)
+	}
+	dest, err := os.CreateTemp(t.TempDir(), "dest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	//goland:noinspection GoUnhandledErrorResult
+	defer dest.Close()
+
+	ps := newParentSeeker("key", src, 1, 0, nil)
+	s1 := newSyncSeeker(ps)
+	_, err = s1.Seek(12, io.SeekStart)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := s1.WriteTo(dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c != int64(len(b)-12) {
+		t.Errorf("Wrote %d bytes but expected %d", c, len(b)-12)
+	}
+	_ = s1.Close()
+
+	written, err := os.ReadFile(dest.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(written, b[12:]) {
+		t.Error("Written bytes do not match source")
+	}
+}
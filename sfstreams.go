@@ -1,27 +1,62 @@
 package sfstreams
 
 import (
+	"container/list"
+	"context"
 	"errors"
-	"fmt"
 	"io"
+	"strconv"
 	"sync"
+	"sync/atomic"
+	"time"
 
+	"golang.org/x/sync/semaphore"
 	"golang.org/x/sync/singleflight"
 )
 
-// ReaderResult carries the return values of Group.Do over the Group.DoChan channel.
+// ReaderResult carries the return values of KeyedGroup.Do over the KeyedGroup.DoChan channel.
 type ReaderResult struct {
 	Err    error
 	Reader io.ReadCloser
 	Shared bool
 }
 
-// Group represents a singleflight stream group. This behaves just like a normal singleflight.Group,
-// but guarantees a usable (distinct) io.ReadCloser to be returned for each call.
-type Group struct {
+// Group represents a singleflight stream group with string keys. This behaves just like a normal
+// singleflight.Group, but guarantees a usable (distinct) io.ReadCloser to be returned for each call.
+type Group = KeyedGroup[string]
+
+// KeyedGroup is a Group which accepts any comparable type as a key, such as a struct identifying a
+// resource. Keys are compared with ==, so distinct keys never share a flight.
+type KeyedGroup[K comparable] struct {
 	sf    singleflight.Group
 	mu    sync.Mutex
-	calls map[string][]chan<- io.ReadCloser
+	calls map[K]*flight // the flight later callers for the key join
+
+	// flights holds every flight for the key whose work function is still running, including those
+	// which are no longer joined because they filled up (see MaxWaitersPerFlight)
+	flights map[K][]*flight
+
+	// singleflight only understands string keys, so each flight is assigned a unique ID
+	flightSeq uint64
+
+	workSem *semaphore.Weighted
+	copySem *semaphore.Weighted
+	budget  *memoryBudget
+
+	broadcasts    map[K]*fanOut
+	subscriptions map[K]*subscription
+	errCache      map[K]*cachedError
+	cache         map[K]*cacheEntry
+	cacheLRU      *list.List // keys of the cache, most recently used first
+	cacheSize     int64
+	cacheLoaded   chan struct{} // closed once the cache on disk has been loaded
+	indexTimer    *time.Timer   // set while a write of the cache's index is pending
+	indexMu       sync.Mutex    // serializes writes of the cache's index
+	spool         *spooler
+
+	ranges     map[K][]*rangeFlight
+	rangeGroup *Group
+	rangeSeq   uint64
 
 	// Normally, the Group will copy the work function's returned reader, but in some cases it is
 	// desirable to maintain the io.Seeker interface. When this option is set to true, the Group
@@ -32,43 +67,300 @@ type Group struct {
 	//
 	// If this is set to true, but the work function doesn't return an io.ReadSeekCloser, the copy
 	// behaviour is used. When false (the default), the copy behaviour is always used.
+	//
+	// When the work function returns an *os.File, the proxy readers pass it directly to io.Writer
+	// implementations which support io.ReaderFrom, letting the runtime use sendfile or similar.
 	UseSeekers bool
+
+	// Retry is the policy applied when a work function returns an error. The work function is retried
+	// on behalf of every caller waiting on the key, rather than each caller retrying independently.
+	// When nil (the default), errors are returned to callers immediately. Use WithRetry to override
+	// the policy for a single call.
+	Retry *RetryPolicy
+
+	// HedgeAfter, when greater than zero, starts a second call to the work function if the first
+	// has not returned and produced its first byte within the duration. Whichever call produces data
+	// first is used, and the stream returned by the other call is closed. This reduces tail latency
+	// when a small share of upstream requests stall, at the cost of occasional duplicate requests.
+	// Use WithHedge to override the threshold for a single call.
+	HedgeAfter time.Duration
+
+	// MaxConcurrentWork, when greater than zero, limits how many work functions may run at the same
+	// time across all keys. Flights beyond the limit are queued until a slot is available, or until
+	// every caller waiting on them has given up (see DoContext). A flight holds its slot while its
+	// work function runs, including any retries and hedged calls.
+	MaxConcurrentWork int
+
+	// MaxConcurrentCopies, when greater than zero, limits how many streams may be copied to their
+	// readers at the same time across all keys. Readers of a queued stream block until it starts.
+	// This only applies to the copy behaviour (see UseSeekers).
+	MaxConcurrentCopies int
+
+	// MemoryBudget, when greater than zero, caps how many bytes of stream data the copy behaviour may
+	// hold in memory at once across all keys. Each chunk read from a source is charged against the
+	// budget until it has been written to every reader. When the budget is exhausted, sources are not
+	// read from until memory is released, applying backpressure to them. Note that a slow reader holds
+	// its flight's chunk, and so its share of the budget, until it catches up.
+	//
+	// Streams held in memory by the cache (see Cache) are charged against the budget too, from the
+	// moment they start being copied until they are evicted and their last reader has been closed. The
+	// cache never takes the last chunk's worth of the budget, and a stream it can't fit is not cached,
+	// so caching never blocks the copies.
+	//
+	// See MemoryInUse for the current usage.
+	MemoryBudget int64
+
+	// MaxWaitersPerFlight, when greater than zero, limits how many callers may share a single flight.
+	// Once a flight for a key is full, the next caller starts a new flight for the key which later
+	// callers join instead. This spreads very popular keys over several calls to the work function
+	// (and so several upstream connections), rather than tying every reader to one source.
+	MaxWaitersPerFlight int
+
+	// Broadcast switches the Group to live broadcast mode, intended for sources such as logs, event
+	// feeds, or live video. A key's source is read continuously, and callers arriving while it is being
+	// read attach at the current position instead of starting a new flight: they only receive the bytes
+	// read after they attached. The source stays open as long as at least one reader of it remains, and
+	// the next caller after the source ends (or every reader has closed) starts a new flight.
+	//
+	// Broadcasts always use the copy behaviour (see UseSeekers).
+	Broadcast bool
+
+	// SubscribeLinger is how long a source opened by Subscribe is kept open after its last subscriber
+	// has gone away. A subscriber arriving in the meantime picks up the source again instead of opening
+	// a new one, which avoids reconnecting to the upstream when subscribers briefly come and go. When
+	// zero (the default), the source is closed as soon as the last subscriber closes its reader.
+	SubscribeLinger time.Duration
+
+	// ErrorCache, when set, remembers the errors returned by work functions so later calls for the
+	// key receive the error immediately, rather than calling the work function again. Errors are only
+	// remembered when the work function returned no stream, and after any retries. When nil (the
+	// default), errors are not remembered. Forget clears a remembered error.
+	ErrorCache *ErrorCachePolicy
+
+	// Cache, when set, keeps completed streams in memory so later calls for the key are served from the
+	// cached copy rather than calling the work function again. Only streams which were copied to the
+	// end are cached: streams from failed work functions, or whose readers all closed early, are not.
+	// When nil (the default), nothing is cached. Forget drops the key's cached copy.
+	//
+	// Caching only applies to the copy behaviour (see UseSeekers), and not to live broadcasts.
+	Cache *CachePolicy
+}
+
+// flight is a single run of a work function, shared by every caller which joined it.
+type flight struct {
+	id      string
+	waiters []chan<- io.ReadCloser
+
+	// detached is set when the flight was forgotten (ErrForgotten) or abandoned (ErrAborted), and so
+	// has nobody to deliver to
+	detached error
+
+	// background is set when the flight was started without a caller, such as to refresh the cache.
+	// It carries on when the callers which joined it give up.
+	background bool
+
+	// restart starts a background flight for the key with the same work function, such as to refresh
+	// the cache ahead of expiry, and reports whether it did. g.mu must be held.
+	restart func() bool
+
+	// ctx is given to the work function. It is cancelled once the flight's source has been closed,
+	// when every caller gave up waiting on the flight, or when every reader of the flight was closed.
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// These are recorded once the work function has returned, see Result
+	meta         *metaBox
+	delivered    int
+	workDuration time.Duration
 }
 
 // Do behaves just like singleflight.Group, with the added guarantee that the returned io.ReadCloser
 // is unique to the caller. The caller is responsible for closing the returned reader. If the work
 // function reader returns an error, all readers generated for the key will return an error too.
 //
-// The returned reader will discard all unread bytes upon being closed, preventing one failed reader
-// from blocking all other readers. Callers should take care to ensure any returned reader gets closed.
+// An error returned by the work function is wrapped in a WorkError, and an error returned by its
+// stream is wrapped in a SourceError. See ErrForgotten, ErrAborted, and ErrReaderClosed for the errors
+// raised by the Group itself.
+//
+// Closing the returned reader detaches it from the flight immediately, unblocking any concurrent Read
+// with an error, while the other readers of the key carry on unaffected. This prevents one failed or
+// abandoned reader from blocking all other readers. Callers should take care to ensure any returned
+// reader gets closed, as readers which are neither read nor closed hold up the other readers.
+//
+// The returned reader implements io.WriterTo, so io.Copy can write the stream to its destination
+// without an intermediate buffer. See UseSeekers for how *os.File sources are handled.
 //
 // The io.ReadCloser generated by fn is closed internally.
-func (g *Group) Do(key string, fn func() (io.ReadCloser, error)) (reader io.ReadCloser, err error, shared bool) {
+func (g *KeyedGroup[K]) Do(key K, fn func() (io.ReadCloser, error), opts ...CallOption) (reader io.ReadCloser, err error, shared bool) {
+	res := g.do(context.Background(), key, func(context.Context) (io.ReadCloser, error) {
+		return fn()
+	}, nil, opts)
+	return res.Reader, res.Err, res.Shared
+}
+
+// DoContext behaves like Do, but stops waiting when ctx is done, returning ctx.Err(). The work function
+// is given a context which is separate from ctx, as the flight may be shared with other callers: it is
+// cancelled once the stream has been fully consumed and closed, when every caller waiting on the flight
+// has given up before the stream was available, or when every reader has been closed before reaching
+// the end of the stream. In the last case, the stream returned by the work function is closed too.
+func (g *KeyedGroup[K]) DoContext(ctx context.Context, key K, fn func(ctx context.Context) (io.ReadCloser, error), opts ...CallOption) (reader io.ReadCloser, err error, shared bool) {
+	res := g.do(ctx, key, fn, nil, opts)
+	return res.Reader, res.Err, res.Shared
+}
+
+// do runs a flight for key. When resume is non-nil, it is used to reopen the source from the last
+// delivered offset if the copy fails partway through.
+func (g *KeyedGroup[K]) do(ctx context.Context, key K, fn func(ctx context.Context) (io.ReadCloser, error), resume func(ctx context.Context, offset int64) (io.ReadCloser, error), opts []CallOption) Result {
 	g.mu.Lock()
-	if g.calls == nil {
-		g.calls = make(map[string][]chan<- io.ReadCloser)
+	g.init()
+	if r, out := g.joinBroadcast(key); r != nil {
+		res := out.f.result(r, nil, true, false)
+		res.Waiters = int(out.live.Load())
+		g.mu.Unlock()
+		return res
 	}
-	if _, ok := g.calls[key]; !ok {
-		g.calls[key] = make([]chan<- io.ReadCloser, 0)
+	if res, ok := g.cachedResult(key, fn, resume, opts); ok {
+		g.mu.Unlock()
+		return res
+	}
+	if err := g.cachedError(key); err != nil {
+		g.mu.Unlock()
+		return Result{Err: err, Shared: true}
+	}
+	f, ok := g.calls[key]
+	if ok && g.MaxWaitersPerFlight > 0 && len(f.waiters) >= g.MaxWaitersPerFlight {
+		ok = false // the flight is full, so start another one for later callers to join
+	}
+	if !ok {
+		f = g.newFlight(key, fn, resume, opts)
 	}
 	resCh := make(chan io.ReadCloser, 1)
-	defer close(resCh)
-	g.calls[key] = append(g.calls[key], resCh)
+	f.waiters = append(f.waiters, resCh)
 
-	valCh := g.sf.DoChan(key, g.doWork(key, fn))
+	valCh := g.sf.DoChan(f.id, g.doWork(key, f, fn, resume, g.callOptions(opts)))
 	g.mu.Unlock()
 
-	res := <-valCh
-	return <-resCh, res.Err, res.Shared
+	select {
+	case res := <-valCh:
+		// Dev note: the flight's results are recorded before any reader is sent, so they're safe to
+		// read once we have ours.
+		return f.result(<-resCh, res.Err, res.Shared, !ok)
+	case <-ctx.Done():
+		g.abandon(key, f, resCh)
+		return Result{Err: ctx.Err()}
+	}
+}
+
+// newFlight creates a flight for key, which later callers join. g.mu must be held.
+func (g *KeyedGroup[K]) newFlight(key K, fn func(ctx context.Context) (io.ReadCloser, error), resume func(ctx context.Context, offset int64) (io.ReadCloser, error), opts []CallOption) *flight {
+	g.flightSeq++
+	f := &flight{id: strconv.FormatUint(g.flightSeq, 10), meta: new(metaBox)}
+	f.ctx, f.cancel = context.WithCancel(context.WithValue(context.Background(), metaKey{}, f.meta))
+	f.restart = func() bool {
+		return g.refresh(key, fn, resume, opts)
+	}
+	g.calls[key] = f
+	g.flights[key] = append(g.flights[key], f)
+	return f
+}
+
+// endFlight stops tracking f, a flight for key, once its work function has returned or it has been
+// abandoned. g.mu must be held.
+func (g *KeyedGroup[K]) endFlight(key K, f *flight) {
+	if g.calls[key] == f {
+		delete(g.calls, key)
+	}
+	flights := g.flights[key]
+	for i, other := range flights {
+		if other == f {
+			flights = append(flights[:i], flights[i+1:]...)
+			break
+		}
+	}
+	if len(flights) == 0 {
+		delete(g.flights, key)
+	} else {
+		g.flights[key] = flights
+	}
+}
+
+// init prepares the group's internal state on first use. g.mu must be held.
+func (g *KeyedGroup[K]) init() {
+	if g.calls != nil {
+		return
+	}
+	if g.Cache != nil && g.Cache.Dir != "" {
+		g.claimCacheDir() // first, so a Group which panics here isn't left half initialised
+	}
+	g.calls = make(map[K]*flight)
+	g.flights = make(map[K][]*flight)
+	g.broadcasts = make(map[K]*fanOut)
+	g.subscriptions = make(map[K]*subscription)
+	g.errCache = make(map[K]*cachedError)
+	g.cache = make(map[K]*cacheEntry)
+	g.cacheLRU = list.New()
+	if g.Cache != nil && g.Cache.Dir != "" {
+		spoolDir := g.Cache.SpoolDir
+		if spoolDir == "" {
+			spoolDir = g.Cache.Dir
+		}
+		minAge := g.Cache.SweepInterval
+		if minAge <= 0 {
+			minAge = spoolGracePeriod
+		}
+		g.spool = newSpooler(spoolDir, g.Cache.Dir, minAge)
+		g.cacheLoaded = make(chan struct{})
+		go g.loadCacheIndex()
+		if g.Cache.SweepInterval > 0 {
+			g.spool.sweepEvery(g.Cache.SweepInterval)
+		}
+	}
+	if g.MaxConcurrentWork > 0 && g.workSem == nil {
+		g.workSem = semaphore.NewWeighted(int64(g.MaxConcurrentWork))
+	}
+	if g.MaxConcurrentCopies > 0 && g.copySem == nil {
+		g.copySem = semaphore.NewWeighted(int64(g.MaxConcurrentCopies))
+	}
+	if g.MemoryBudget > 0 && g.budget == nil {
+		g.budget = newMemoryBudget(g.MemoryBudget)
+	}
+}
+
+// abandon removes a caller which gave up waiting from its flight. The flight is stopped if nobody is
+// waiting on it anymore.
+func (g *KeyedGroup[K]) abandon(key K, f *flight, resCh chan io.ReadCloser) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for i, ch := range f.waiters {
+		if ch == resCh {
+			f.waiters = append(f.waiters[:i], f.waiters[i+1:]...)
+			if len(f.waiters) == 0 && !f.background {
+				f.cancel()
+				f.detached = ErrAborted
+				g.endFlight(key, f)
+				g.sf.Forget(f.id)
+			}
+			return
+		}
+	}
+
+	// The flight already picked up the caller, so close the reader once it arrives
+	go func() {
+		if r := <-resCh; r != nil {
+			_ = r.Close()
+		}
+	}()
 }
 
-// DoChan runs Group.Do, but returns a channel that will receive the results/stream when ready.
+// DoChan runs KeyedGroup.Do, but returns a channel that will receive the results/stream when ready.
+// The result must be received and its reader closed, otherwise it holds up the other readers of the
+// key. See DoChanContext for callers which may stop listening.
 //
 // The returned channel is not closed.
-func (g *Group) DoChan(key string, fn func() (io.ReadCloser, error)) <-chan ReaderResult {
+func (g *KeyedGroup[K]) DoChan(key K, fn func() (io.ReadCloser, error), opts ...CallOption) <-chan ReaderResult {
 	ch := make(chan ReaderResult, 1)
-	go func(ch chan ReaderResult, g *Group) {
-		r, err, shared := g.Do(key, fn)
+	go func(ch chan ReaderResult, g *KeyedGroup[K]) {
+		r, err, shared := g.Do(key, fn, opts...)
 		ch <- ReaderResult{
 			Err:    err,
 			Reader: r,
@@ -78,33 +370,100 @@ func (g *Group) DoChan(key string, fn func() (io.ReadCloser, error)) <-chan Read
 	return ch
 }
 
-// Forget acts just like singleflight.Group.
-func (g *Group) Forget(key string) {
+// DoChanContext runs KeyedGroup.DoContext, but returns a channel that will receive the results/stream
+// when ready. Unlike DoChan, the returned channel is unbuffered: if ctx is done before the result has
+// been received, the reader is closed (detaching it from the flight) instead of being left in the
+// channel where it would hold up the other readers of the key. This makes it safe to stop listening
+// after racing the channel against a timeout, provided ctx is done by then. Typically, ctx is cancelled
+// (or times out) alongside the caller giving up.
+//
+// The returned channel is closed once the result has been received, or once the result was dropped
+// because ctx is done. Once ctx is done, whether the result is still delivered is a race, so a receive
+// may instead report the channel as closed (returning the zero ReaderResult, which has no reader).
+// Callers receiving after ctx is done should check for this, such as with res, ok := <-ch.
+func (g *KeyedGroup[K]) DoChanContext(ctx context.Context, key K, fn func(ctx context.Context) (io.ReadCloser, error), opts ...CallOption) <-chan ReaderResult {
+	ch := make(chan ReaderResult)
+	go func(ch chan ReaderResult, g *KeyedGroup[K]) {
+		defer close(ch)
+		r, err, shared := g.DoContext(ctx, key, fn, opts...)
+		select {
+		case ch <- ReaderResult{
+			Err:    err,
+			Reader: r,
+			Shared: shared,
+		}:
+		case <-ctx.Done():
+			// Nobody is listening anymore, so don't let the reader hold up the flight
+			if r != nil {
+				_ = r.Close()
+			}
+		}
+	}(ch, g)
+	return ch
+}
+
+// Forget acts just like singleflight.Group. Every in-flight call for the key is detached, including
+// those which later callers no longer join (see MaxWaitersPerFlight), and callers waiting on them
+// receive ErrForgotten. In-flight ranges of the key (see DoRange), live broadcasts of the key (see
+// Broadcast), subscriptions to the key (see Subscribe), any error remembered for the key (see
+// ErrorCache), and the key's cached stream (see Cache) are forgotten too, so later calls start a new
+// flight. Existing readers are unaffected.
+func (g *KeyedGroup[K]) Forget(key K) {
 	g.mu.Lock()
-	if chans, ok := g.calls[key]; ok {
-		for _, ch := range chans {
+	g.forget(key)
+	g.mu.Unlock()
+}
+
+// forget implements Forget. g.mu must be held.
+func (g *KeyedGroup[K]) forget(key K) {
+	for _, f := range g.flights[key] {
+		for _, ch := range f.waiters {
 			close(ch)
 		}
+		f.waiters = nil
+		f.detached = ErrForgotten
+		g.sf.Forget(f.id)
 	}
 	delete(g.calls, key)
-	g.sf.Forget(key)
-	g.mu.Unlock()
+	delete(g.flights, key)
+	delete(g.broadcasts, key)
+	delete(g.subscriptions, key)
+	delete(g.errCache, key)
+	if e, ok := g.cache[key]; ok {
+		g.dropCache(key, e)
+	}
+	for _, f := range g.ranges[key] {
+		g.rangeGroup.Forget(f.id)
+	}
+	delete(g.ranges, key)
 }
 
-func (g *Group) doWork(key string, fn func() (io.ReadCloser, error)) func() (interface{}, error) {
+func (g *KeyedGroup[K]) doWork(key K, f *flight, fn func(ctx context.Context) (io.ReadCloser, error), resume func(ctx context.Context, offset int64) (io.ReadCloser, error), opts *callOptions) func() (interface{}, error) {
 	return func() (interface{}, error) {
-		fnRes, fnErr := fn()
+		start := time.Now()
+		fnRes, fnErr := g.openSource(f.ctx, fn, opts)
+		workDuration := time.Since(start)
 
 		g.mu.Lock()
 		defer g.mu.Unlock()
-		g.sf.Forget(key) // we won't be processing future calls, so wrap it up
-		if chans, ok := g.calls[key]; !ok {
-			return nil, fmt.Errorf("expected to find singleflight key \"%s\", but didn't", key)
+		g.sf.Forget(f.id) // we won't be processing future calls, so wrap it up
+		if f.detached != nil {
+			// The flight was forgotten or abandoned while the work function was running
+			if fnRes != nil {
+				_ = fnRes.Close()
+			}
+			f.cancel()
+			return nil, f.detached
 		} else {
 			var zero io.ReadCloser
 			canStream := fnRes != nil && fnRes != zero
 
-			delete(g.calls, key) // we've done all we can for this call: clear it before we unlock
+			// we've done all we can for this call: clear it before we unlock
+			chans := f.waiters
+			f.waiters = nil
+			f.delivered = len(chans)
+			f.workDuration = workDuration
+			g.endFlight(key, f)
 
 			if !canStream {
 				for _, ch := range chans {
@@ -113,83 +472,252 @@ func (g *Group) doWork(key string, fn func() (io.ReadCloser, error)) func() (int
 						ch <- nil
 					}(ch)
 				}
-				return nil, fnErr // we intentionally discard the return value
+				f.cancel()
+				err := workError(key, fnErr)
+				g.cacheError(key, fnErr, err)
+				g.refreshDone(key)
+				return nil, err // we intentionally discard the return value
 			}
 
-			if g.UseSeekers {
+			if g.UseSeekers && !g.Broadcast && len(chans) > 0 {
 				if rsc, ok := fnRes.(io.ReadSeekCloser); ok {
-					parent := newParentSeeker(rsc, len(chans))
+					parent := newParentSeeker(key, rsc, len(chans), 0, f.cancel)
 					for _, ch := range chans {
 						// This needs to be async to prevent a deadlock
 						go func(ch chan<- io.ReadCloser) {
 							ch <- newSyncSeeker(parent)
 						}(ch)
 					}
-					return nil, fnErr // we intentionally discard the return value
+					return nil, workError(key, fnErr) // we intentionally discard the return value
 				}
 			}
 
-			writers := make([]*io.PipeWriter, len(chans))
+			out, readers := newFanOut(f, len(chans))
 			for i, ch := range chans {
-				r, w := io.Pipe()
-				writers[i] = w
-
 				// This needs to be async to prevent a deadlock
-				go func(r io.ReadCloser, ch chan<- io.ReadCloser) {
-					ch <- newDiscardCloser(r)
-				}(r, ch)
+				go func(r *pipeReader, ch chan<- io.ReadCloser) {
+					ch <- r
+				}(readers[i], ch)
+			}
+			if g.Broadcast {
+				g.broadcasts[key] = out
 			}
 
 			// Do the io copy async to prevent holding up other singleflight calls
-			go finishCopy(writers, fnRes)
+			go g.finishCopy(key, f, out, fnRes, resume, opts)
+
+			return nil, workError(key, fnErr) // we intentionally discard the return value
+		}
+	}
+}
 
-			return nil, fnErr // we intentionally discard the return value
+// openSource calls the work function, following the concurrency limit, retry policy, and hedging.
+func (g *KeyedGroup[K]) openSource(ctx context.Context, fn func(ctx context.Context) (io.ReadCloser, error), opts *callOptions) (io.ReadCloser, error) {
+	if g.workSem != nil {
+		if err := acquire(ctx, g.workSem, 1); err != nil {
+			return nil, err
 		}
+		defer g.workSem.Release(1)
+	}
+	return opts.retry.call(ctx, func(ctx context.Context) (io.ReadCloser, error) {
+		return hedge(ctx, fn, opts.hedgeAfter)
+	})
+}
+
+// copyStream copies src to dst, charging the memory budget if there is one.
+func (g *KeyedGroup[K]) copyStream(ctx context.Context, dst io.Writer, src io.Reader) (int64, error) {
+	if g.budget != nil {
+		return g.budget.copy(ctx, dst, src)
+	}
+	return io.Copy(dst, src)
+}
+
+// acquire takes n from sem. Unlike semaphore.Weighted.Acquire, it never succeeds once ctx is done.
+func acquire(ctx context.Context, sem *semaphore.Weighted, n int64) error {
+	if err := sem.Acquire(ctx, n); err != nil {
+		return err
+	}
+	if err := ctx.Err(); err != nil {
+		sem.Release(n)
+		return err
 	}
+	return nil
 }
 
-func finishCopy(writers []*io.PipeWriter, fnRes io.ReadCloser) {
-	defer func(fnRes io.ReadCloser) {
-		_ = fnRes.Close()
-	}(fnRes)
+func (g *KeyedGroup[K]) finishCopy(key K, f *flight, out *fanOut, fnRes io.ReadCloser, resume func(ctx context.Context, offset int64) (io.ReadCloser, error), opts *callOptions) {
+	defer f.cancel()
+	if g.Broadcast {
+		defer g.endBroadcast(key, out)
+	}
 
 	// Dev note: Errors are raised through the pipe writers using CloseWithError, which
 	// should make them available on the pipe readers. We can consume them here.
-	mw := newAsyncMultiWriter(writers...)
-	_, copyErr := io.Copy(mw, fnRes)
-	_ = mw.CloseWithMaybeError(copyErr)
+	mw := out.mw
+	var dst io.Writer = mw
+	var fill *cacheFill
+	if g.Cache != nil && !g.Broadcast {
+		fill = newCacheFill(mw, g.Cache, g.spool, g.budget)
+		dst = fill
+		defer func() {
+			g.fillCache(key, f, fill)
+		}()
+	}
+	if g.copySem != nil {
+		if err := acquire(f.ctx, g.copySem, 1); err != nil {
+			_ = fnRes.Close()
+			_ = mw.CloseWithMaybeError(ErrAborted)
+			return
+		}
+		defer g.copySem.Release(1)
+	}
+
+	src := &flightSource{r: fnRes}
+	copyDone := make(chan struct{})
+	defer close(copyDone)
+	go func() {
+		select {
+		case <-f.ctx.Done():
+			// Every reader has gone away, so interrupt the source rather than reading it to the end
+			src.interrupt()
+		case <-copyDone:
+		}
+	}()
+
+	delivered := int64(0)
+	attempt := 0
+	for {
+		n, copyErr := g.copyStream(f.ctx, dst, src)
+		_ = src.Close()
+		delivered += n
+		if copyErr == nil || resume == nil || f.ctx.Err() != nil {
+			if copyErr == nil && fill != nil {
+				fill.complete = true
+			}
+			_ = mw.CloseWithMaybeError(copyError(f.ctx, key, copyErr, delivered))
+			return
+		}
+
+		if n > 0 {
+			attempt = 0 // the source made progress, so it gets a fresh set of attempts
+		}
+		fnRes, attempt, copyErr = resumeSource(f.ctx, resume, delivered, attempt, copyErr, opts.retry)
+		if copyErr == nil && !src.replace(fnRes) {
+			copyErr = ErrAborted
+		}
+		if copyErr != nil {
+			_ = mw.CloseWithMaybeError(copyError(f.ctx, key, copyErr, delivered))
+			return
+		}
+	}
 }
 
-// discardCloser discards any remaining data on the underlying reader on close.
-type discardCloser struct {
-	io.ReadCloser
-	r io.ReadCloser
+// flightSource is the source a flight copies from. It can be interrupted from another goroutine to
+// stop the copy, and replaced when the flight resumes.
+type flightSource struct {
+	mu          sync.Mutex
+	r           io.ReadCloser
+	closed      bool
+	interrupted bool
 }
 
-// newDiscardCloser creates a new discardCloser from an input io.ReadCloser
-func newDiscardCloser(r io.ReadCloser) *discardCloser {
-	return &discardCloser{r: r}
+func (s *flightSource) Read(p []byte) (int, error) {
+	s.mu.Lock()
+	r := s.r
+	s.mu.Unlock()
+	return r.Read(p)
 }
 
-func (d *discardCloser) Read(p []byte) (int, error) {
-	return d.r.Read(p)
+func (s *flightSource) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+	return s.r.Close()
 }
 
-func (d *discardCloser) Close() error {
-	if _, err := io.Copy(io.Discard, d.r); err != nil {
-		return err
+// interrupt closes the source, and prevents it from being replaced.
+func (s *flightSource) interrupt() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.interrupted = true
+	if !s.closed {
+		s.closed = true
+		_ = s.r.Close()
+	}
+}
+
+// replace swaps in a new source, returning false (and closing r) if the source was interrupted.
+func (s *flightSource) replace(r io.ReadCloser) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.interrupted {
+		_ = r.Close()
+		return false
+	}
+	s.r = r
+	s.closed = false
+	return true
+}
+
+// fanOut is the set of readers a flight's source is copied to.
+type fanOut struct {
+	f    *flight
+	mw   *asyncMultiWriter
+	live atomic.Int32
+}
+
+// newFanOut creates a fanOut with the given number of readers.
+func newFanOut(f *flight, readers int) (*fanOut, []*pipeReader) {
+	out := &fanOut{f: f}
+	out.live.Store(int32(readers))
+	rs := make([]*pipeReader, readers)
+	writers := make([]*pipeWriter, readers)
+	for i := range rs {
+		rs[i], writers[i] = newPipe(out.readerClosed)
+	}
+	out.mw = newAsyncMultiWriter(writers...)
+	return out, rs
+}
+
+// readerClosed is called when one of the readers is closed. Once every reader has been closed there's
+// nobody left to copy to, so the flight is cancelled, which in turn stops the copy.
+func (o *fanOut) readerClosed() {
+	if o.live.Add(-1) == 0 {
+		o.f.cancel()
+	}
+}
+
+// attach adds a reader which receives the data written after it was attached. It returns nil if every
+// reader has already been closed, or the copy has finished.
+func (o *fanOut) attach() *pipeReader {
+	for {
+		n := o.live.Load()
+		if n == 0 {
+			return nil
+		}
+		if o.live.CompareAndSwap(n, n+1) {
+			break
+		}
 	}
-	return d.r.Close()
+	r, w := newPipe(o.readerClosed)
+	if !o.mw.add(w) {
+		_ = r.Close()
+		return nil
+	}
+	return r
 }
 
 type asyncMultiWriter struct {
 	io.WriteCloser
-	writers   []*io.PipeWriter
+	writers   []*pipeWriter
 	skipFlags []bool
+	closed    bool
 	mu        *sync.Mutex
 }
 
-func newAsyncMultiWriter(writers ...*io.PipeWriter) *asyncMultiWriter {
+func newAsyncMultiWriter(writers ...*pipeWriter) *asyncMultiWriter {
 	return &asyncMultiWriter{
 		writers:   writers,
 		skipFlags: make([]bool, len(writers)),
@@ -197,6 +725,18 @@ func newAsyncMultiWriter(writers ...*io.PipeWriter) *asyncMultiWriter {
 	}
 }
 
+// add starts writing to w from the next Write, returning false if the writer has been closed.
+func (a *asyncMultiWriter) add(w *pipeWriter) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.closed {
+		return false
+	}
+	a.writers = append(a.writers, w)
+	a.skipFlags = append(a.skipFlags, false)
+	return true
+}
+
 type writeResponse struct {
 	i   int
 	err error
@@ -231,24 +771,47 @@ func (a *asyncMultiWriter) Write(p []byte) (int, error) {
 	wg.Wait()
 
 	maxRead := 0
+	live := c
 	for i := 0; i < c; i++ {
 		res := <-ch
 		if res.n > maxRead {
 			maxRead = res.n
 		}
 		if res.err != nil {
+			// The reader has gone away (or is otherwise broken), so stop writing to it
 			w := a.writers[res.i]
 			_ = w.CloseWithError(res.err)
-			a.skipFlags[i] = true
+			a.skipFlags[res.i] = true
+			live--
+		}
+	}
+
+	if live < len(a.writers) {
+		// Forget the writers which have gone away, so long-lived broadcasts and subscriptions
+		// don't accumulate them as readers come and go
+		writers := a.writers[:0]
+		for i, w := range a.writers {
+			if !a.skipFlags[i] {
+				writers = append(writers, w)
+			}
 		}
+		for i := len(writers); i < len(a.writers); i++ {
+			a.writers[i] = nil
+		}
+		a.writers = writers
+		a.skipFlags = make([]bool, len(writers))
 	}
 
+	if live == 0 {
+		return maxRead, ErrAborted // every reader has been closed
+	}
 	return maxRead, nil
 }
 
 func (a *asyncMultiWriter) Close() error {
 	a.mu.Lock()
 	defer a.mu.Unlock()
+	a.closed = true
 
 	errs := make([]error, 0)
 	for i, w := range a.writers {
@@ -272,6 +835,7 @@ func (a *asyncMultiWriter) CloseWithMaybeError(inError error) error {
 
 	a.mu.Lock()
 	defer a.mu.Unlock()
+	a.closed = true
 
 	errs := make([]error, 0)
 	for i, w := range a.writers {
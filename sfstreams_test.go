@@ -2,10 +2,13 @@ package sfstreams
 
 import (
 	"bytes"
+	"context"
 	"crypto/rand"
 	"errors"
 	"io"
+	"strconv"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -76,7 +79,7 @@ func TestDoError(t *testing.T) {
 
 	g := new(Group)
 	r, err, shared := g.Do("test", workFn)
-	if err != nil && err != expectedErr {
+	if err != nil && !errors.Is(err, expectedErr) {
 		t.Fatal(err)
 	}
 	if shared {
@@ -177,7 +180,7 @@ func TestDoErrorAndStream(t *testing.T) {
 
 	g := new(Group)
 	r, err, shared := g.Do(key, workFn)
-	if err != expectedErr {
+	if !errors.Is(err, expectedErr) {
 		t.Error("Expected a different error")
 	}
 	if shared {
@@ -244,7 +247,7 @@ func TestDoChanError(t *testing.T) {
 	g := new(Group)
 	ch := g.DoChan("key", workFn)
 	res := <-ch
-	if res.Err != nil && res.Err != expectedErr {
+	if res.Err != nil && !errors.Is(res.Err, expectedErr) {
 		t.Fatal(res.Err)
 	}
 	if res.Shared {
@@ -295,7 +298,7 @@ func TestDoChanErrorAndStream(t *testing.T) {
 	g := new(Group)
 	ch := g.DoChan(key, workFn)
 	res := <-ch
-	if res.Err != expectedError {
+	if !errors.Is(res.Err, expectedError) {
 		t.Error("Expected a different error")
 	}
 	if res.Shared {
@@ -418,7 +421,7 @@ func TestFasterRead(t *testing.T) {
 		if i%2 == 0 {
 			time.Sleep(1 * time.Second)
 		} else {
-			// early close (which should discard)
+			// early close (which should detach)
 			err := r.Close()
 			if err != nil {
 				t.Error(err)
@@ -626,3 +629,553 @@ func TestSeekerUsesParent(t *testing.T) {
 	}
 
 }
+
+func TestReturnsWriterTo(t *testing.T) {
+	for _, useSeekers := range []bool{false, true} {
+		key, expectedBytes, src := makeStream()
+		expected, _ := io.ReadAll(src)
+		src = nopSeekCloser(bytes.NewReader(expected))
+
+		workFn := func() (io.ReadCloser, error) {
+			return src, nil
+		}
+
+		g := new(Group)
+		g.UseSeekers = useSeekers
+		r, err, _ := g.Do(key, workFn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		wt, ok := r.(io.WriterTo)
+		if !ok {
+			t.Fatalf("Expected reader to be an io.WriterTo (seekers: %t)", useSeekers)
+		}
+
+		buf := new(bytes.Buffer)
+		c, err := wt.WriteTo(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if c != expectedBytes {
+			t.Errorf("Wrote %d bytes but expected %d (seekers: %t)", c, expectedBytes, useSeekers)
+		}
+		if !bytes.Equal(buf.Bytes(), expected) {
+			t.Errorf("Written bytes do not match source (seekers: %t)", useSeekers)
+		}
+		_ = r.Close()
+	}
+}
+
+func TestKeyedGroupStructKeys(t *testing.T) {
+	type objectKey struct {
+		bucket  string
+		object  string
+		version int
+	}
+
+	_, expectedBytes, src := makeStream()
+	callCount := 0
+	workFn := func() (io.ReadCloser, error) {
+		callCount++
+		return src, nil
+	}
+
+	g := new(KeyedGroup[objectKey])
+	r, err, shared := g.Do(objectKey{bucket: "b", object: "o", version: 1}, workFn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if shared {
+		t.Error("Expected a non-shared result")
+	}
+
+	//goland:noinspection GoUnhandledErrorResult
+	defer r.Close()
+	c, _ := io.Copy(io.Discard, r)
+	if c != expectedBytes {
+		t.Errorf("Read %d bytes but expected %d", c, expectedBytes)
+	}
+	if callCount != 1 {
+		t.Errorf("Expected 1 call, got %d", callCount)
+	}
+}
+
+func TestKeyedGroupDistinctKeys(t *testing.T) {
+	type objectKey struct {
+		bucket string
+		object string
+	}
+
+	gate := make(chan struct{})
+	mu := new(sync.Mutex)
+	callCount := 0
+	workFn := func() (io.ReadCloser, error) {
+		mu.Lock()
+		callCount++
+		mu.Unlock()
+		<-gate
+		_, _, src := makeStream()
+		return src, nil
+	}
+
+	g := new(KeyedGroup[objectKey])
+	wg := new(sync.WaitGroup)
+	keys := []objectKey{{"a", "b"}, {"a", "c"}, {"a", "b"}}
+	for _, key := range keys {
+		wg.Add(1)
+		go func(key objectKey) {
+			defer wg.Done()
+			r, err, _ := g.Do(key, workFn)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			//goland:noinspection GoUnhandledErrorResult
+			defer r.Close()
+			_, _ = io.Copy(io.Discard, r)
+		}(key)
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(gate)
+	wg.Wait()
+
+	if callCount != 2 {
+		t.Errorf("Expected 2 calls, got %d", callCount)
+	}
+}
+
+func TestDoContextCancelled(t *testing.T) {
+	workCtxDone := make(chan struct{})
+	workFn := func(ctx context.Context) (io.ReadCloser, error) {
+		<-ctx.Done()
+		close(workCtxDone)
+		return nil, ctx.Err()
+	}
+
+	g := new(Group)
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	r, err, _ := g.DoContext(ctx, "key", workFn)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected deadline exceeded, got %v", err)
+	}
+	if r != nil {
+		t.Error("Expected no reader")
+	}
+
+	select {
+	case <-workCtxDone:
+	case <-time.After(time.Second):
+		t.Error("Expected the work function's context to be cancelled")
+	}
+}
+
+func TestDoContextOtherCallerCancels(t *testing.T) {
+	key, expectedBytes, src := makeStream()
+
+	gate := make(chan struct{})
+	workFn := func(ctx context.Context) (io.ReadCloser, error) {
+		<-gate
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return src, nil
+	}
+
+	g := new(Group)
+	ctx, cancel := context.WithCancel(context.Background())
+	wg := new(sync.WaitGroup)
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		_, err, _ := g.DoContext(ctx, key, workFn)
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("Expected cancellation, got %v", err)
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		r, err, _ := g.DoContext(context.Background(), key, workFn)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		//goland:noinspection GoUnhandledErrorResult
+		defer r.Close()
+		c, _ := io.Copy(io.Discard, r)
+		if c != expectedBytes {
+			t.Errorf("Read %d bytes but expected %d", c, expectedBytes)
+		}
+	}()
+	time.Sleep(20 * time.Millisecond)
+	cancel()
+	time.Sleep(20 * time.Millisecond)
+	close(gate)
+	wg.Wait()
+}
+
+func TestDoChanContext(t *testing.T) {
+	key, expectedBytes, src := makeStream()
+
+	callCount := 0
+	workFn := func(ctx context.Context) (io.ReadCloser, error) {
+		callCount++
+		return src, nil
+	}
+
+	g := new(Group)
+	res := <-g.DoChanContext(context.Background(), key, workFn)
+	if res.Err != nil {
+		t.Fatal(res.Err)
+	}
+
+	//goland:noinspection GoUnhandledErrorResult
+	defer res.Reader.Close()
+	c, _ := io.Copy(io.Discard, res.Reader)
+	if c != expectedBytes {
+		t.Errorf("Read %d bytes but expected %d", c, expectedBytes)
+	}
+	if callCount != 1 {
+		t.Errorf("Expected 1 call, got %d", callCount)
+	}
+}
+
+func TestDoChanContextAbandoned(t *testing.T) {
+	key, expectedBytes, src := makeStream()
+
+	gate := make(chan struct{})
+	workFn := func(ctx context.Context) (io.ReadCloser, error) {
+		<-gate
+		return src, nil
+	}
+
+	g := new(Group)
+	ctx, cancel := context.WithCancel(context.Background())
+	_ = g.DoChanContext(ctx, key, workFn) // never received from
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		r, err, _ := g.DoContext(context.Background(), key, workFn)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		//goland:noinspection GoUnhandledErrorResult
+		defer r.Close()
+		c, _ := io.Copy(io.Discard, r)
+		if c != expectedBytes {
+			t.Errorf("Read %d bytes but expected %d", c, expectedBytes)
+		}
+	}()
+	time.Sleep(20 * time.Millisecond)
+	close(gate)
+	time.Sleep(20 * time.Millisecond)
+	cancel()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Expected the abandoned result to stop holding up the other reader")
+	}
+}
+
+func TestDoChanContextCancelled(t *testing.T) {
+	key, _, src := makeStream()
+	workFn := func(ctx context.Context) (io.ReadCloser, error) {
+		return src, nil
+	}
+
+	g := new(Group)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	ch := g.DoChanContext(ctx, key, workFn)
+
+	// Whether or not the result is delivered, receiving never blocks once ctx is done
+	select {
+	case res, ok := <-ch:
+		if ok && res.Reader != nil {
+			_ = res.Reader.Close()
+		}
+		if _, ok = <-ch; ok {
+			t.Error("Expected the channel to be closed")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected the channel to be closed")
+	}
+}
+
+func TestMaxConcurrentWork(t *testing.T) {
+	mu := new(sync.Mutex)
+	running := 0
+	maxRunning := 0
+	workFn := func() (io.ReadCloser, error) {
+		mu.Lock()
+		running++
+		if running > maxRunning {
+			maxRunning = running
+		}
+		mu.Unlock()
+		time.Sleep(20 * time.Millisecond)
+		mu.Lock()
+		running--
+		mu.Unlock()
+		_, _, src := makeStream()
+		return src, nil
+	}
+
+	g := new(Group)
+	g.MaxConcurrentWork = 2
+	g.MaxConcurrentCopies = 1
+	wg := new(sync.WaitGroup)
+	for i := 0; i < 6; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			r, err, _ := g.Do("key"+strconv.Itoa(i), workFn)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			//goland:noinspection GoUnhandledErrorResult
+			defer r.Close()
+			_, _ = io.Copy(io.Discard, r)
+		}(i)
+	}
+	wg.Wait()
+
+	if maxRunning != 2 {
+		t.Errorf("Expected 2 concurrent work functions, got %d", maxRunning)
+	}
+}
+
+func TestMaxConcurrentWorkQueueCancelled(t *testing.T) {
+	started := make(chan struct{})
+	gate := make(chan struct{})
+	blockingFn := func() (io.ReadCloser, error) {
+		close(started)
+		<-gate
+		_, _, src := makeStream()
+		return src, nil
+	}
+	queuedCalled := new(atomic.Bool)
+	queuedFn := func(ctx context.Context) (io.ReadCloser, error) {
+		queuedCalled.Store(true)
+		return nil, nil
+	}
+
+	g := new(Group)
+	g.MaxConcurrentWork = 1
+	ch := g.DoChan("blocking", blockingFn)
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	_, err, _ := g.DoContext(ctx, "queued", queuedFn)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected deadline exceeded, got %v", err)
+	}
+
+	close(gate)
+	res := <-ch
+	if res.Err != nil {
+		t.Fatal(res.Err)
+	}
+	_ = res.Reader.Close()
+
+	// Give the queued flight a chance to (incorrectly) run
+	time.Sleep(20 * time.Millisecond)
+	if queuedCalled.Load() {
+		t.Error("Expected the abandoned flight to not call its work function")
+	}
+}
+
+func TestMaxWaitersPerFlight(t *testing.T) {
+	key, expectedBytes, _ := makeStream()
+
+	mu := new(sync.Mutex)
+	callCount := 0
+	gate := make(chan struct{})
+	workFn := func() (io.ReadCloser, error) {
+		mu.Lock()
+		callCount++
+		mu.Unlock()
+		<-gate
+		_, _, src := makeStream()
+		return src, nil
+	}
+
+	g := new(Group)
+	g.MaxWaitersPerFlight = 2
+	wg := new(sync.WaitGroup)
+	const max = 5
+	for i := 0; i < max; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			r, err, _ := g.Do(key, workFn)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			//goland:noinspection GoUnhandledErrorResult
+			defer r.Close()
+			c, _ := io.Copy(io.Discard, r)
+			if c != expectedBytes {
+				t.Errorf("Read %d bytes but expected %d", c, expectedBytes)
+			}
+		}()
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(gate)
+	wg.Wait()
+
+	if callCount != 3 {
+		t.Errorf("Expected 3 calls, got %d", callCount)
+	}
+}
+
+// slowReader produces its bytes in small chunks with a delay before each.
+type slowReader struct {
+	r     io.Reader
+	delay time.Duration
+}
+
+func (s *slowReader) Read(p []byte) (int, error) {
+	time.Sleep(s.delay)
+	if len(p) > 1024 {
+		p = p[:1024]
+	}
+	return s.r.Read(p)
+}
+
+func (s *slowReader) Close() error {
+	return nil
+}
+
+func TestCloseDetachesImmediately(t *testing.T) {
+	_, expectedBytes, src := makeStream()
+
+	gate := make(chan struct{})
+	workFn := func() (io.ReadCloser, error) {
+		<-gate
+		return &slowReader{r: src, delay: 5 * time.Millisecond}, nil
+	}
+
+	g := new(Group)
+	wg := new(sync.WaitGroup)
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		r, err, _ := g.Do("key", workFn)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		//goland:noinspection GoUnhandledErrorResult
+		defer r.Close()
+		c, err := io.Copy(io.Discard, r)
+		if err != nil {
+			t.Error(err)
+		}
+		if c != expectedBytes {
+			t.Errorf("Read %d bytes but expected %d", c, expectedBytes)
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		r, err, _ := g.Do("key", workFn)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		// Block a read on the (not yet written) next chunk, then close while it's blocked
+		readErr := make(chan error, 1)
+		go func() {
+			_, err := io.Copy(io.Discard, r)
+			readErr <- err
+		}()
+		time.Sleep(10 * time.Millisecond)
+
+		start := time.Now()
+		if err = r.Close(); err != nil {
+			t.Error(err)
+		}
+		if time.Since(start) > 5*time.Millisecond {
+			t.Error("Expected Close to return without draining the stream")
+		}
+		select {
+		case err = <-readErr:
+			if !errors.Is(err, io.ErrClosedPipe) {
+				t.Errorf("Expected a closed pipe error, got %v", err)
+			}
+		case <-time.After(time.Second):
+			t.Error("Expected Close to unblock the pending read")
+		}
+	}()
+	time.Sleep(20 * time.Millisecond)
+	close(gate)
+	wg.Wait()
+}
+
+// endlessReader produces bytes until it is closed.
+type endlessReader struct {
+	closed *atomic.Bool
+}
+
+func (e *endlessReader) Read(p []byte) (int, error) {
+	if e.closed.Load() {
+		return 0, io.ErrClosedPipe
+	}
+	time.Sleep(time.Millisecond)
+	return len(p), nil
+}
+
+func (e *endlessReader) Close() error {
+	e.closed.Store(true)
+	return nil
+}
+
+func TestCancelWhenAllReadersClose(t *testing.T) {
+	closed := new(atomic.Bool)
+	workCtxDone := make(chan struct{})
+	gate := make(chan struct{})
+	workFn := func(ctx context.Context) (io.ReadCloser, error) {
+		go func() {
+			<-ctx.Done()
+			close(workCtxDone)
+		}()
+		<-gate
+		return &endlessReader{closed: closed}, nil
+	}
+
+	g := new(Group)
+	wg := new(sync.WaitGroup)
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			r, err, _ := g.DoContext(context.Background(), "key", workFn)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			_, _ = io.CopyN(io.Discard, r, 64*1024)
+			_ = r.Close()
+		}()
+	}
+	time.Sleep(20 * time.Millisecond)
+	close(gate)
+	wg.Wait()
+
+	select {
+	case <-workCtxDone:
+	case <-time.After(time.Second):
+		t.Fatal("Expected the work function's context to be cancelled")
+	}
+	time.Sleep(10 * time.Millisecond)
+	if !closed.Load() {
+		t.Error("Expected the source to be closed")
+	}
+}
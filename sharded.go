@@ -0,0 +1,138 @@
+package sfstreams
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+)
+
+// ShardedGroup partitions keys across several independent Groups by hash. Each Group has its own
+// lock, so a ShardedGroup reduces contention when many distinct keys are in flight at once. Calls for
+// the same key always land on the same Group, and so are deduplicated just like they would be on a
+// single Group.
+type ShardedGroup struct {
+	shards []*Group
+}
+
+// NewShardedGroup creates a ShardedGroup with the given number of shards. If shards is less than 1,
+// runtime.GOMAXPROCS(0) shards are used.
+//
+// newGroup is called once per shard to create (and configure) that shard's Group, for example to set
+// UseSeekers. When nil, new(Group) is used.
+//
+// When the shards cache on disk (see CachePolicy.Dir), each shard is given a subdirectory of Dir named
+// after it, which is created if needed. Keys are assigned to shards by the number of shards, so
+// streams cached with a different number of shards are not reused.
+func NewShardedGroup(shards int, newGroup func() *Group) *ShardedGroup {
+	if shards < 1 {
+		shards = runtime.GOMAXPROCS(0)
+	}
+	if newGroup == nil {
+		newGroup = func() *Group {
+			return new(Group)
+		}
+	}
+	s := &ShardedGroup{shards: make([]*Group, shards)}
+	for i := range s.shards {
+		g := newGroup()
+		if g.Cache != nil && g.Cache.Dir != "" {
+			// Dev note: the policy is copied, as newGroup may share one between the shards.
+			policy := *g.Cache
+			policy.Dir = filepath.Join(policy.Dir, "shard-"+strconv.Itoa(i))
+			_ = os.MkdirAll(policy.Dir, 0o700)
+			g.Cache = &policy
+		}
+		s.shards[i] = g
+	}
+	return s
+}
+
+// Shard returns the Group responsible for key.
+func (s *ShardedGroup) Shard(key string) *Group {
+	// 32-bit FNV-1a, inlined to avoid allocating a []byte for the key
+	h := uint32(2166136261)
+	for i := 0; i < len(key); i++ {
+		h ^= uint32(key[i])
+		h *= 16777619
+	}
+	return s.shards[h%uint32(len(s.shards))]
+}
+
+// Do runs Group.Do on the key's shard.
+func (s *ShardedGroup) Do(key string, fn func() (io.ReadCloser, error), opts ...CallOption) (reader io.ReadCloser, err error, shared bool) {
+	return s.Shard(key).Do(key, fn, opts...)
+}
+
+// DoContext runs Group.DoContext on the key's shard.
+func (s *ShardedGroup) DoContext(ctx context.Context, key string, fn func(ctx context.Context) (io.ReadCloser, error), opts ...CallOption) (reader io.ReadCloser, err error, shared bool) {
+	return s.Shard(key).DoContext(ctx, key, fn, opts...)
+}
+
+// DoResult runs Group.DoResult on the key's shard.
+func (s *ShardedGroup) DoResult(ctx context.Context, key string, fn func(ctx context.Context) (io.ReadCloser, error), opts ...CallOption) Result {
+	return s.Shard(key).DoResult(ctx, key, fn, opts...)
+}
+
+// DoChan runs Group.DoChan on the key's shard.
+func (s *ShardedGroup) DoChan(key string, fn func() (io.ReadCloser, error), opts ...CallOption) <-chan ReaderResult {
+	return s.Shard(key).DoChan(key, fn, opts...)
+}
+
+// DoChanContext runs Group.DoChanContext on the key's shard.
+func (s *ShardedGroup) DoChanContext(ctx context.Context, key string, fn func(ctx context.Context) (io.ReadCloser, error), opts ...CallOption) <-chan ReaderResult {
+	return s.Shard(key).DoChanContext(ctx, key, fn, opts...)
+}
+
+// DoRange runs Group.DoRange on the key's shard.
+func (s *ShardedGroup) DoRange(key string, offset int64, length int64, fn func(offset int64, length int64) (io.ReadCloser, error), opts ...CallOption) (reader io.ReadCloser, err error, shared bool) {
+	return s.Shard(key).DoRange(key, offset, length, fn, opts...)
+}
+
+// DoResumable runs Group.DoResumable on the key's shard.
+func (s *ShardedGroup) DoResumable(key string, fn func(offset int64) (io.ReadCloser, error), opts ...CallOption) (reader io.ReadCloser, err error, shared bool) {
+	return s.Shard(key).DoResumable(key, fn, opts...)
+}
+
+// Subscribe runs Group.Subscribe on the key's shard.
+func (s *ShardedGroup) Subscribe(key string, fn func() (io.ReadCloser, error), opts ...CallOption) (reader io.ReadCloser, err error, shared bool) {
+	return s.Shard(key).Subscribe(key, fn, opts...)
+}
+
+// Prefetch runs Group.Prefetch on the key's shard.
+func (s *ShardedGroup) Prefetch(key string, fn func() (io.ReadCloser, error), opts ...CallOption) {
+	s.Shard(key).Prefetch(key, fn, opts...)
+}
+
+// Forget runs Group.Forget on the key's shard.
+func (s *ShardedGroup) Forget(key string) {
+	s.Shard(key).Forget(key)
+}
+
+// ForgetFunc runs Group.ForgetFunc on every shard.
+func (s *ShardedGroup) ForgetFunc(match func(key string) bool) {
+	for _, g := range s.shards {
+		g.ForgetFunc(match)
+	}
+}
+
+// ForgetPrefix runs ForgetPrefix on every shard.
+func (s *ShardedGroup) ForgetPrefix(prefix string) {
+	for _, g := range s.shards {
+		ForgetPrefix(g, prefix)
+	}
+}
+
+// Close runs Group.Close on every shard.
+func (s *ShardedGroup) Close() error {
+	errs := make([]error, 0)
+	for _, g := range s.shards {
+		if err := g.Close(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
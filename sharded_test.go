@@ -0,0 +1,143 @@
+package sfstreams
+
+import (
+	"bytes"
+	"io"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestShardedGroupDo(t *testing.T) {
+	key, expectedBytes, src := makeStream()
+
+	callCount := 0
+	workFn := func() (io.ReadCloser, error) {
+		callCount++
+		return src, nil
+	}
+
+	g := NewShardedGroup(4, nil)
+	r, err, shared := g.Do(key, workFn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if shared {
+		t.Error("Expected a non-shared result")
+	}
+
+	//goland:noinspection GoUnhandledErrorResult
+	defer r.Close()
+	c, _ := io.Copy(io.Discard, r)
+	if c != expectedBytes {
+		t.Errorf("Read %d bytes but expected %d", c, expectedBytes)
+	}
+	if callCount != 1 {
+		t.Errorf("Expected 1 call, got %d", callCount)
+	}
+}
+
+func TestShardedGroupDuplicates(t *testing.T) {
+	key, expectedBytes, src := makeStream()
+
+	mu := new(sync.Mutex)
+	callCount := 0
+	gate := make(chan struct{})
+	workFn := func() (io.ReadCloser, error) {
+		mu.Lock()
+		callCount++
+		mu.Unlock()
+		<-gate
+		return src, nil
+	}
+
+	g := NewShardedGroup(8, nil)
+	wg := new(sync.WaitGroup)
+	const max = 10
+	for i := 0; i < max; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			r, err, _ := g.Do(key, workFn)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			//goland:noinspection GoUnhandledErrorResult
+			defer r.Close()
+			c, _ := io.Copy(io.Discard, r)
+			if c != expectedBytes {
+				t.Errorf("Read %d bytes but expected %d", c, expectedBytes)
+			}
+		}()
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(gate)
+	wg.Wait()
+
+	if callCount != 1 {
+		t.Errorf("Expected 1 call, got %d", callCount)
+	}
+}
+
+func TestShardedGroupDistributes(t *testing.T) {
+	g := NewShardedGroup(4, func() *Group {
+		return &Group{UseSeekers: true}
+	})
+	seen := make(map[*Group]bool)
+	for i := 0; i < 100; i++ {
+		key := "key" + strconv.Itoa(i)
+		shard := g.Shard(key)
+		if shard != g.Shard(key) {
+			t.Fatal("Expected the same shard for the same key")
+		}
+		if !shard.UseSeekers {
+			t.Fatal("Expected shards to be configured by newGroup")
+		}
+		seen[shard] = true
+	}
+	if len(seen) != 4 {
+		t.Errorf("Expected keys to use all 4 shards, used %d", len(seen))
+	}
+}
+
+func TestShardedGroupDiskCache(t *testing.T) {
+	dir := t.TempDir()
+	callCount := new(atomic.Int32)
+	workFn := func() (io.ReadCloser, error) {
+		callCount.Add(1)
+		return io.NopCloser(bytes.NewReader([]byte("hello"))), nil
+	}
+
+	// The shards share a policy, but each caches to a directory of its own
+	policy := &CachePolicy{TTL: time.Minute, Dir: dir, SweepInterval: 30 * time.Millisecond}
+	g := NewShardedGroup(4, func() *Group {
+		return &Group{Cache: policy}
+	})
+	//goland:noinspection GoUnhandledErrorResult
+	defer g.Close()
+	read := func(key string) {
+		r, err, _ := g.Do(key, workFn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, _ = io.Copy(io.Discard, r)
+		_ = r.Close()
+	}
+	for i := 0; i < 8; i++ {
+		read("key" + strconv.Itoa(i))
+	}
+	time.Sleep(100 * time.Millisecond) // let the flights finish caching, and the shards sweep
+
+	for i := 0; i < 8; i++ {
+		read("key" + strconv.Itoa(i))
+	}
+	if callCount.Load() != 8 {
+		t.Errorf("Expected 8 calls, got %d", callCount.Load())
+	}
+	if policy.Dir != dir {
+		t.Error("Expected the shared policy to be left unchanged")
+	}
+}
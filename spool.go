@@ -0,0 +1,184 @@
+package sfstreams
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// spoolPrefix starts the names of the files a spooler writes, which are followed by the ID of the
+// process which wrote them.
+const spoolPrefix = "sfstreams-"
+
+// spoolGracePeriod is how long files named after the current process are left alone after they were
+// last modified, when the Group doesn't sweep in the background (see CachePolicy.SweepInterval).
+const spoolGracePeriod = time.Minute
+
+// ownedFiles holds the files in use by the Groups in the process. It is shared by every spooler, as
+// Groups may share a directory (such as SpoolDir) and must not sweep each other's files, which are
+// named after the same process.
+var ownedFiles = struct {
+	sync.Mutex
+	files map[string]bool
+}{files: make(map[string]bool)}
+
+// spooler manages the files a Group writes to disk: streams being spooled while they are copied, and
+// the cached streams they become (see CachePolicy.Dir). It tracks which files are in use so they
+// aren't swept, and sweeps up any other files it would have written, such as those left behind by a
+// crashed process.
+type spooler struct {
+	dirs    []string // the directories swept, the first of which files are spooled to
+	pattern string
+	minAge  time.Duration // how long files named after this process are left alone once modified
+
+	mu      sync.Mutex
+	timer   *time.Timer // the next background sweep, see sweepEvery
+	stopped bool
+}
+
+func newSpooler(spoolDir string, cacheDir string, minAge time.Duration) *spooler {
+	dirs := []string{spoolDir}
+	if filepath.Clean(cacheDir) != filepath.Clean(spoolDir) {
+		dirs = append(dirs, cacheDir)
+	}
+	return &spooler{
+		dirs: dirs,
+		// The process ID tells sweeps whether the process which wrote a file is still running, and the
+		// random part added by os.CreateTemp keeps the name unique.
+		pattern: spoolPrefix + strconv.Itoa(os.Getpid()) + "-*" + spoolSuffix,
+		minAge:  minAge,
+	}
+}
+
+// spoolOwner returns the ID of the process which wrote the file with the given name, or false if the
+// name isn't one a spooler would have written.
+func spoolOwner(name string) (int, bool) {
+	if !strings.HasSuffix(name, spoolSuffix) && !strings.HasSuffix(name, cacheSuffix) {
+		return 0, false
+	}
+	rest := strings.TrimPrefix(name, spoolPrefix)
+	if rest == name {
+		return 0, false
+	}
+	pid, _, ok := strings.Cut(rest, "-")
+	if !ok {
+		return 0, false
+	}
+	n, err := strconv.Atoi(pid)
+	if err != nil || n <= 0 {
+		return 0, false
+	}
+	return n, true
+}
+
+// create creates a new spool file.
+func (s *spooler) create() (*os.File, error) {
+	return s.createIn(s.dirs[0])
+}
+
+// createIn creates a new spool file in dir, such as to write a file which is then renamed into place.
+// The file is owned until it's removed or disowned.
+func (s *spooler) createIn(dir string) (*os.File, error) {
+	f, err := os.CreateTemp(dir, s.pattern)
+	if err != nil {
+		return nil, err
+	}
+	s.own(f.Name())
+	return f, nil
+}
+
+// own marks the file as in use, so it isn't swept.
+func (s *spooler) own(file string) {
+	ownedFiles.Lock()
+	defer ownedFiles.Unlock()
+	ownedFiles.files[absPath(file)] = true
+}
+
+// disown marks the file as no longer in use, for example after it was renamed.
+func (s *spooler) disown(file string) {
+	ownedFiles.Lock()
+	defer ownedFiles.Unlock()
+	delete(ownedFiles.files, absPath(file))
+}
+
+// remove deletes the file. If it can't be deleted right now, such as when another process has it open
+// on some platforms, the next sweep tries again.
+func (s *spooler) remove(file string) {
+	_ = os.Remove(file)
+	s.disown(file)
+}
+
+// sweep deletes the spool and cache files which are not in use, and were written by a process which
+// is no longer running. Files named after this process, which may also have been written by a crashed
+// process with the same ID (such as in a container), are left alone if they were modified within
+// minAge. This avoids racing with files which are being created.
+func (s *spooler) sweep() {
+	cutoff := time.Now().Add(-s.minAge)
+	self := os.Getpid()
+	for _, dir := range s.dirs {
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			continue
+		}
+		for _, de := range entries {
+			pid, ok := spoolOwner(de.Name())
+			if de.IsDir() || !ok {
+				continue
+			}
+			if pid != self && processAlive(pid) {
+				continue // another process is still using the directory, such as during a deploy
+			}
+			file := filepath.Join(dir, de.Name())
+			ownedFiles.Lock()
+			owned := ownedFiles.files[absPath(file)]
+			ownedFiles.Unlock()
+			if owned {
+				continue
+			}
+			if pid == self {
+				info, err := de.Info()
+				if err != nil || info.ModTime().After(cutoff) {
+					continue
+				}
+			}
+			_ = os.Remove(file)
+		}
+	}
+}
+
+// sweepEvery sweeps the directories every interval, until stop is called.
+func (s *spooler) sweepEvery(interval time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.stopped {
+		return
+	}
+	s.timer = time.AfterFunc(interval, func() {
+		s.sweep()
+		s.sweepEvery(interval)
+	})
+}
+
+// sweepAfter sweeps the directories once after d, unless stop is called first.
+func (s *spooler) sweepAfter(d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.stopped {
+		return
+	}
+	s.timer = time.AfterFunc(d, s.sweep)
+}
+
+// stop stops the background sweeps started by sweepEvery or sweepAfter.
+func (s *spooler) stop() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.stopped = true
+	if s.timer != nil {
+		s.timer.Stop()
+		s.timer = nil
+	}
+}
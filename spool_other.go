@@ -0,0 +1,19 @@
+//go:build !unix
+
+package sfstreams
+
+import (
+	"os"
+)
+
+// processAlive reports whether a process with the given ID is running. Where this can't be checked,
+// the process is assumed to be running, leaving its files alone.
+func processAlive(pid int) bool {
+	// Dev note: on Windows, FindProcess fails if there is no such process.
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	_ = p.Release()
+	return true
+}
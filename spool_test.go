@@ -0,0 +1,264 @@
+package sfstreams
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSpoolDir(t *testing.T) {
+	dir := t.TempDir()
+	spoolDir := t.TempDir()
+	gate := make(chan struct{})
+	workFn := func(ctx context.Context) (io.ReadCloser, error) {
+		return io.NopCloser(io.MultiReader(bytes.NewReader([]byte("hello ")), &gatedReader{gate: gate}, bytes.NewReader([]byte("world")))), nil
+	}
+
+	g := &Group{Cache: &CachePolicy{TTL: time.Minute, Dir: dir, SpoolDir: spoolDir}}
+	//goland:noinspection GoUnhandledErrorResult
+	defer g.Close()
+	res := g.DoResult(context.Background(), "key", workFn)
+	if res.Err != nil {
+		t.Fatal(res.Err)
+	}
+	time.Sleep(10 * time.Millisecond)
+
+	// While the stream is being copied, it is spooled
+	files := cacheFiles(t, spoolDir)
+	if len(files) != 1 || !strings.HasPrefix(files[0], "sfstreams-"+strconv.Itoa(os.Getpid())+"-") || !strings.HasSuffix(files[0], spoolSuffix) {
+		t.Errorf("Expected a spool file named after the process, got %v", files)
+	}
+
+	close(gate)
+	if b := readResult(t, res); string(b) != "hello world" {
+		t.Errorf("Unexpected stream: %s", b)
+	}
+	time.Sleep(10 * time.Millisecond)
+	if files = cacheFiles(t, spoolDir); len(files) != 0 {
+		t.Errorf("Expected the spool file to be moved, got %v", files)
+	}
+	if files = cacheFiles(t, dir); len(files) != 1 {
+		t.Errorf("Expected a cached file, got %v", files)
+	}
+}
+
+// gatedReader returns io.EOF once gate is closed.
+type gatedReader struct {
+	gate chan struct{}
+}
+
+func (r *gatedReader) Read(p []byte) (int, error) {
+	<-r.gate
+	return 0, io.EOF
+}
+
+func TestSpoolRemovedWhenNotCacheable(t *testing.T) {
+	dir := t.TempDir()
+	key, expectedBytes, _ := makeStream()
+	workFn := func() (io.ReadCloser, error) {
+		_, _, src := makeStream()
+		return src, nil
+	}
+
+	g := &Group{Cache: &CachePolicy{TTL: time.Minute, Dir: dir, MaxEntrySize: expectedBytes / 2}}
+	//goland:noinspection GoUnhandledErrorResult
+	defer g.Close()
+	r, err, _ := g.Do(key, workFn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, _ := io.Copy(io.Discard, r)
+	_ = r.Close()
+	if c != expectedBytes {
+		t.Errorf("Read %d bytes but expected %d", c, expectedBytes)
+	}
+	time.Sleep(10 * time.Millisecond)
+	if files := cacheFiles(t, dir); len(files) != 0 {
+		t.Errorf("Expected no files to be left behind, got %v", files)
+	}
+}
+
+func TestCachedFileRemovedAfterLastReader(t *testing.T) {
+	dir := t.TempDir()
+	workFn := func(ctx context.Context) (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader([]byte("hello"))), nil
+	}
+
+	g := &Group{Cache: &CachePolicy{TTL: time.Minute, Dir: dir}}
+	//goland:noinspection GoUnhandledErrorResult
+	defer g.Close()
+	readResult(t, g.DoResult(context.Background(), "key", workFn))
+	time.Sleep(10 * time.Millisecond)
+
+	res := g.DoResult(context.Background(), "key", workFn)
+	if !res.Cached {
+		t.Fatal("Expected a cached result")
+	}
+	g.Forget("key")
+	if files := cacheFiles(t, dir); len(files) != 1 {
+		t.Errorf("Expected the file to be kept while it is being read, got %v", files)
+	}
+	if b := readResult(t, res); string(b) != "hello" {
+		t.Errorf("Unexpected stream: %s", b)
+	}
+	if files := cacheFiles(t, dir); len(files) != 0 {
+		t.Errorf("Expected the file to be removed after the last reader closed, got %v", files)
+	}
+}
+
+// deadPID returns the ID of a process which isn't running.
+func deadPID(t *testing.T) int {
+	for pid := 1 << 22; pid > 1<<20; pid-- {
+		if !processAlive(pid) {
+			return pid
+		}
+	}
+	t.Skip("No unused process ID found")
+	return 0
+}
+
+// writeOldFile writes a file to dir which was last modified an hour ago.
+func writeOldFile(t *testing.T, dir string, name string) {
+	file := filepath.Join(dir, name)
+	if err := os.WriteFile(file, []byte("old"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	old := time.Now().Add(-time.Hour)
+	if err := os.Chtimes(file, old, old); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSpoolSweep(t *testing.T) {
+	dir := t.TempDir()
+	workFn := func(ctx context.Context) (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader([]byte("hello"))), nil
+	}
+
+	g := &Group{Cache: &CachePolicy{TTL: time.Minute, Dir: dir, SweepInterval: 20 * time.Millisecond}}
+	loadCache(g)
+	//goland:noinspection GoUnhandledErrorResult
+	defer g.Close()
+	readResult(t, g.DoResult(context.Background(), "key", workFn))
+	time.Sleep(10 * time.Millisecond)
+
+	// Files which appear later, such as from another process which crashed, are swept once they're old
+	crashed := spoolPrefix + strconv.Itoa(deadPID(t)) + "-"
+	writeOldFile(t, dir, crashed+"orphan"+spoolSuffix)
+	writeOldFile(t, dir, crashed+"orphan"+cacheSuffix)
+
+	// Files of processes which are still running, and files of other software, are left alone
+	live := spoolPrefix + strconv.Itoa(os.Getppid()) + "-"
+	writeOldFile(t, dir, live+"live"+spoolSuffix)
+	writeOldFile(t, dir, "other"+spoolSuffix)
+	writeOldFile(t, dir, "unrelated.txt")
+	time.Sleep(60 * time.Millisecond)
+
+	files := cacheFiles(t, dir)
+	if len(files) != 4 {
+		t.Errorf("Expected the cached file and the files of others to remain, got %v", files)
+	}
+	for _, name := range files {
+		if strings.Contains(name, "orphan") {
+			t.Errorf("Expected %s to be swept", name)
+		}
+	}
+	res := g.DoResult(context.Background(), "key", workFn)
+	if !res.Cached {
+		t.Error("Expected the cached stream to survive the sweep")
+	}
+	readResult(t, res)
+}
+
+func TestSpoolSweepAtStartup(t *testing.T) {
+	dir := t.TempDir()
+	spoolDir := t.TempDir()
+
+	crashed := spoolPrefix + strconv.Itoa(deadPID(t)) + "-"
+	writeOldFile(t, spoolDir, crashed+"orphan"+spoolSuffix)
+	writeOldFile(t, spoolDir, crashed+"orphan"+cacheSuffix)
+	writeOldFile(t, spoolDir, "other"+spoolSuffix)
+	if err := os.WriteFile(filepath.Join(spoolDir, crashed+"recent"+spoolSuffix), []byte("new"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	// Dev note: a crashed process with our ID could have written this, but it might also be in use
+	own := spoolPrefix + strconv.Itoa(os.Getpid()) + "-recent" + spoolSuffix
+	if err := os.WriteFile(filepath.Join(spoolDir, own), []byte("new"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	g := &Group{Cache: &CachePolicy{TTL: time.Minute, Dir: dir, SpoolDir: spoolDir}}
+	loadCache(g)
+	//goland:noinspection GoUnhandledErrorResult
+	defer g.Close()
+
+	files := cacheFiles(t, spoolDir)
+	if len(files) != 2 {
+		t.Errorf("Expected our recent file and the file of other software to remain, got %v", files)
+	}
+	for _, name := range files {
+		if strings.HasPrefix(name, crashed) {
+			t.Errorf("Expected %s to be swept", name)
+		}
+	}
+}
+
+func TestSpoolSweepStops(t *testing.T) {
+	dir := t.TempDir()
+	g := &Group{Cache: &CachePolicy{TTL: time.Minute, Dir: dir, SweepInterval: 20 * time.Millisecond}}
+	loadCache(g)
+	if err := g.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	crashed := spoolPrefix + strconv.Itoa(deadPID(t)) + "-"
+	writeOldFile(t, dir, crashed+"orphan"+spoolSuffix)
+	time.Sleep(60 * time.Millisecond)
+	if files := cacheFiles(t, dir); len(files) != 1 {
+		t.Errorf("Expected no sweeps after Close, got %v", files)
+	}
+}
+
+func TestSpoolSweepSharedDir(t *testing.T) {
+	spoolDir := t.TempDir()
+	gate := make(chan struct{})
+	workFn := func(ctx context.Context) (io.ReadCloser, error) {
+		return io.NopCloser(io.MultiReader(bytes.NewReader([]byte("hello ")), &gatedReader{gate: gate}, bytes.NewReader([]byte("world")))), nil
+	}
+
+	// Both Groups spool to the same directory, which one sweeps while the other is still spooling
+	sweeper := &Group{Cache: &CachePolicy{TTL: time.Minute, Dir: t.TempDir(), SpoolDir: spoolDir, SweepInterval: 20 * time.Millisecond}}
+	loadCache(sweeper)
+	//goland:noinspection GoUnhandledErrorResult
+	defer sweeper.Close()
+	g := &Group{Cache: &CachePolicy{TTL: time.Minute, Dir: t.TempDir(), SpoolDir: spoolDir}}
+	loadCache(g)
+	//goland:noinspection GoUnhandledErrorResult
+	defer g.Close()
+
+	res := g.DoResult(context.Background(), "key", workFn)
+	if res.Err != nil {
+		t.Fatal(res.Err)
+	}
+	time.Sleep(80 * time.Millisecond)
+	if files := cacheFiles(t, spoolDir); len(files) != 1 {
+		t.Errorf("Expected the spool file of the other Group to be left alone, got %v", files)
+	}
+
+	close(gate)
+	readResult(t, res)
+	time.Sleep(10 * time.Millisecond)
+	res = g.DoResult(context.Background(), "key", workFn)
+	if !res.Cached {
+		t.Error("Expected the stream to be cached")
+	}
+	if b := readResult(t, res); string(b) != "hello world" {
+		t.Errorf("Unexpected stream: %s", b)
+	}
+}
@@ -0,0 +1,166 @@
+package sfstreams
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sync"
+)
+
+// subscription is a long-lived source shared by every subscriber of a key (see KeyedGroup.Subscribe).
+type subscription struct {
+	ready chan struct{} // closed once the source has been opened, or failed to open
+	err   error
+
+	refs   *refCount
+	parent *parentSeeker     // set when subscribers share a seekable source (see UseSeekers)
+	out    *asyncMultiWriter // set when the source is copied to subscribers
+}
+
+// Subscribe opens a long-lived subscription to key's source, such as a log being tailed or an event
+// feed. The first subscriber opens the source by calling fn. Subscribers arriving while it is open
+// share it, rather than opening another one, and only receive the bytes read after they subscribed.
+// The source is read as long as at least one subscriber remains, and is closed after the last one
+// closes its reader and SubscribeLinger has passed without another subscriber arriving. If the source
+// ends or fails, every subscriber receives its EOF or error, and the next subscriber opens it again.
+//
+// When UseSeekers is set and fn returns an io.ReadSeekCloser, subscribers are instead given proxy
+// readers which start at the beginning of the source and can seek within it, as with Do.
+//
+// shared is true when the subscriber joined a source which was already open. The caller is responsible
+// for closing the returned reader.
+func (g *KeyedGroup[K]) Subscribe(key K, fn func() (io.ReadCloser, error), opts ...CallOption) (reader io.ReadCloser, err error, shared bool) {
+	for {
+		g.mu.Lock()
+		g.init()
+		s, ok := g.subscriptions[key]
+		if !ok {
+			s = &subscription{ready: make(chan struct{})}
+			g.subscriptions[key] = s
+			g.mu.Unlock()
+			return g.openSubscription(key, s, fn, g.callOptions(opts))
+		}
+		g.mu.Unlock()
+
+		<-s.ready
+		if s.err != nil {
+			return nil, s.err, true
+		}
+		if r := s.attach(); r != nil {
+			return r, nil, true
+		}
+
+		// The source ended while we were attaching, so open it again
+		g.endSubscription(key, s)
+	}
+}
+
+// openSubscription opens the source for a new subscription, returning the first subscriber's reader.
+func (g *KeyedGroup[K]) openSubscription(key K, s *subscription, fn func() (io.ReadCloser, error), opts *callOptions) (io.ReadCloser, error, bool) {
+	ctx, cancel := context.WithCancel(context.Background())
+	src, err := g.openSource(ctx, func(context.Context) (io.ReadCloser, error) {
+		return fn()
+	}, opts)
+	var zero io.ReadCloser
+	if err == nil && (src == nil || src == zero) {
+		err = errors.New("sfstreams: subscription source is nil")
+	}
+	if err != nil {
+		cancel()
+		g.endSubscription(key, s)
+		s.err = workError(key, err)
+		close(s.ready)
+		return nil, s.err, false
+	}
+	defer close(s.ready)
+
+	if g.UseSeekers {
+		if rsc, ok := src.(io.ReadSeekCloser); ok {
+			s.parent = newParentSeeker(key, rsc, 1, g.SubscribeLinger, func() {
+				cancel()
+				g.endSubscription(key, s)
+			})
+			s.refs = s.parent.refs
+			return newSyncSeeker(s.parent), nil, false
+		}
+	}
+
+	stopOnce := new(sync.Once)
+	stop := func(err error) {
+		stopOnce.Do(func() {
+			cancel()
+			g.endSubscription(key, s)
+			_ = src.Close()
+			_ = s.out.CloseWithMaybeError(err)
+		})
+	}
+	s.refs = newRefCount(1, g.SubscribeLinger, func() {
+		stop(nil)
+	})
+	r, w := newPipe(s.refs.done)
+	s.out = newAsyncMultiWriter(w)
+
+	// Do the io copy async so the subscriber can start reading
+	go func() {
+		n, err := g.copyStream(ctx, subscriberWriter{s.out}, subscribedReader{src, s.refs})
+		stop(copyError(ctx, key, err, n))
+	}()
+
+	return r, nil, false
+}
+
+// endSubscription stops new subscribers from joining s.
+func (g *KeyedGroup[K]) endSubscription(key K, s *subscription) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.subscriptions[key] == s {
+		delete(g.subscriptions, key)
+	}
+}
+
+// attach adds a subscriber, returning nil if the source has already been closed.
+func (s *subscription) attach() io.ReadCloser {
+	if s.parent != nil {
+		if r := s.parent.attach(); r != nil {
+			return r
+		}
+		return nil
+	}
+	if !s.refs.acquire() {
+		return nil
+	}
+	r, w := newPipe(s.refs.done)
+	if !s.out.add(w) {
+		// Dev note: the source has ended, so there's nothing left for the reference to keep open
+		return nil
+	}
+	return r
+}
+
+// subscribedReader reads from a subscription's source, pausing while nobody is subscribed. Once the
+// subscription has been released, it returns ErrAborted.
+type subscribedReader struct {
+	r    io.Reader
+	refs *refCount
+}
+
+func (r subscribedReader) Read(p []byte) (int, error) {
+	if !r.refs.wait() {
+		return 0, ErrAborted
+	}
+	return r.r.Read(p)
+}
+
+// subscriberWriter writes to a subscription's readers. Unlike a flight, a subscription outlives its
+// readers, so the data is dropped when there is nobody to write it to.
+type subscriberWriter struct {
+	mw *asyncMultiWriter
+}
+
+func (w subscriberWriter) Write(p []byte) (int, error) {
+	n, err := w.mw.Write(p)
+	if errors.Is(err, ErrAborted) {
+		return len(p), nil
+	}
+	return n, err
+}
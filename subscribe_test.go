@@ -0,0 +1,258 @@
+package sfstreams
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type seekCloseTracker struct {
+	*bytes.Reader
+	closed atomic.Bool
+}
+
+func (c *seekCloseTracker) Close() error {
+	c.closed.Store(true)
+	return nil
+}
+
+func TestSubscribeShares(t *testing.T) {
+	mu := new(sync.Mutex)
+	callCount := 0
+	closed := new(atomic.Bool)
+	openFn := func() (io.ReadCloser, error) {
+		mu.Lock()
+		callCount++
+		mu.Unlock()
+		return &counterSource{closed: closed}, nil
+	}
+
+	g := new(Group)
+	r1, err, shared := g.Subscribe("key", openFn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if shared {
+		t.Error("Expected the first subscriber to not be shared")
+	}
+	if n := readCounter(t, r1); n != 0 {
+		t.Errorf("Expected the first subscriber to start at 0, got %d", n)
+	}
+
+	// Keep the first subscriber reading so the source carries on
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+				readCounter(t, r1)
+			}
+		}
+	}()
+	time.Sleep(20 * time.Millisecond)
+
+	r2, err, shared := g.Subscribe("key", openFn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !shared {
+		t.Error("Expected the second subscriber to be shared")
+	}
+	first := readCounter(t, r2)
+	if first == 0 {
+		t.Error("Expected the second subscriber to start at the current position")
+	}
+	if second := readCounter(t, r2); second != first+1 {
+		t.Errorf("Expected counter %d, got %d", first+1, second)
+	}
+
+	close(stop)
+	<-done
+	_ = r1.Close()
+	if closed.Load() {
+		t.Error("Expected the source to remain open while a subscriber remains")
+	}
+	_ = r2.Close()
+	time.Sleep(20 * time.Millisecond)
+	if !closed.Load() {
+		t.Error("Expected the source to be closed after the last subscriber left")
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if callCount != 1 {
+		t.Errorf("Expected 1 call, got %d", callCount)
+	}
+}
+
+func TestSubscribeLinger(t *testing.T) {
+	mu := new(sync.Mutex)
+	callCount := 0
+	closed := new(atomic.Bool)
+	openFn := func() (io.ReadCloser, error) {
+		mu.Lock()
+		callCount++
+		mu.Unlock()
+		closed.Store(false)
+		return &counterSource{closed: closed}, nil
+	}
+	getCallCount := func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		return callCount
+	}
+
+	g := &Group{SubscribeLinger: 100 * time.Millisecond}
+	r, err, _ := g.Subscribe("key", openFn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	last := readCounter(t, r)
+	_ = r.Close()
+
+	// Resubscribing within the linger period picks up the same source
+	time.Sleep(20 * time.Millisecond)
+	r, err, shared := g.Subscribe("key", openFn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !shared {
+		t.Error("Expected the lingering source to be shared")
+	}
+	if n := readCounter(t, r); n <= last {
+		t.Errorf("Expected the source to carry on after %d, got %d", last, n)
+	}
+	_ = r.Close()
+	if getCallCount() != 1 {
+		t.Errorf("Expected 1 call, got %d", getCallCount())
+	}
+
+	// ... but not after it
+	time.Sleep(200 * time.Millisecond)
+	if !closed.Load() {
+		t.Error("Expected the source to be closed after the linger period")
+	}
+	r, err, shared = g.Subscribe("key", openFn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	//goland:noinspection GoUnhandledErrorResult
+	defer r.Close()
+	if shared {
+		t.Error("Expected a new source after the linger period")
+	}
+	if n := readCounter(t, r); n != 0 {
+		t.Errorf("Expected the new source to start at 0, got %d", n)
+	}
+	if getCallCount() != 2 {
+		t.Errorf("Expected 2 calls, got %d", getCallCount())
+	}
+}
+
+func TestSubscribeSourceEnds(t *testing.T) {
+	key, expectedBytes, _ := makeStream()
+	callCount := 0
+	openFn := func() (io.ReadCloser, error) {
+		callCount++
+		_, _, src := makeStream()
+		return src, nil
+	}
+
+	g := &Group{SubscribeLinger: time.Minute}
+	for i := 0; i < 2; i++ {
+		r, err, shared := g.Subscribe(key, openFn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if shared {
+			t.Error("Expected an ended source to be reopened")
+		}
+		c, _ := io.Copy(io.Discard, r)
+		if c != expectedBytes {
+			t.Errorf("Read %d bytes but expected %d", c, expectedBytes)
+		}
+		_ = r.Close()
+		time.Sleep(10 * time.Millisecond) // let the subscription wind down
+	}
+	if callCount != 2 {
+		t.Errorf("Expected 2 calls, got %d", callCount)
+	}
+}
+
+func TestSubscribeError(t *testing.T) {
+	expectedErr := errors.New("test error")
+	g := new(Group)
+	r, err, _ := g.Subscribe("key", func() (io.ReadCloser, error) {
+		return nil, expectedErr
+	})
+	if r != nil {
+		t.Error("Expected no reader")
+	}
+	if !errors.Is(err, expectedErr) {
+		t.Errorf("Expected %v, got %v", expectedErr, err)
+	}
+
+	// The failure isn't remembered
+	r, err, _ = g.Subscribe("key", func() (io.ReadCloser, error) {
+		_, _, src := makeStream()
+		return src, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = r.Close()
+}
+
+func TestSubscribeSeekers(t *testing.T) {
+	b := make([]byte, 1024)
+	for i := range b {
+		b[i] = byte(i)
+	}
+	tracker := &seekCloseTracker{Reader: bytes.NewReader(b)}
+	callCount := 0
+	openFn := func() (io.ReadCloser, error) {
+		callCount++
+		return tracker, nil
+	}
+
+	g := &Group{UseSeekers: true}
+	r1, err, _ := g.Subscribe("key", openFn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = io.CopyN(io.Discard, r1, 100)
+	r2, err, shared := g.Subscribe("key", openFn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !shared {
+		t.Error("Expected the second subscriber to be shared")
+	}
+	if _, ok := r2.(io.ReadSeekCloser); !ok {
+		t.Error("Expected a seeker")
+	}
+	res, _ := io.ReadAll(r2)
+	if !bytes.Equal(res, b) {
+		t.Error("Expected the seeker to read the whole source")
+	}
+
+	_ = r1.Close()
+	if tracker.closed.Load() {
+		t.Error("Expected the source to remain open while a subscriber remains")
+	}
+	_ = r2.Close()
+	if !tracker.closed.Load() {
+		t.Error("Expected the source to be closed after the last subscriber left")
+	}
+	if callCount != 1 {
+		t.Errorf("Expected 1 call, got %d", callCount)
+	}
+}